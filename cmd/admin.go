@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal"
+)
+
+// create_admin_handler serves the admin API. Every request has to carry the
+// token as bearer token. The current handler is acquired per request, because
+// it is replaced when the configuration is reloaded.
+func create_admin_handler(token string, current_handler func() (*internal.AuthHandler, func()), reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		auth_handler, release := current_handler()
+		defer release()
+		flush_cache_handler(w, r, auth_handler)
+	})
+	mux.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		auth_handler, release := current_handler()
+		defer release()
+		list_cache_handler(w, auth_handler)
+	})
+	mux.HandleFunc("DELETE /cache/{user}", func(w http.ResponseWriter, r *http.Request) {
+		auth_handler, release := current_handler()
+		defer release()
+		evict_cache_handler(w, r, auth_handler)
+	})
+	mux.HandleFunc("POST /config/reload", func(w http.ResponseWriter, r *http.Request) {
+		reload_config_handler(w, reload)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !is_admin_token_valid(token, r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			write_json(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func is_admin_token_valid(token string, r *http.Request) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && found && subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// flushes the cache entries of the user given as query parameter or all
+// entries if there is no user
+func flush_cache_handler(w http.ResponseWriter, r *http.Request, auth_handler *internal.AuthHandler) {
+	user := r.URL.Query().Get("user")
+	flushed, err := auth_handler.FlushCache(user)
+	if err != nil {
+		log.Printf("flushing cache failed: %v", err)
+		write_json(w, http.StatusInternalServerError, map[string]string{"error": "flushing cache failed"})
+		return
+	}
+	write_json(w, http.StatusOK, map[string]int{"flushed": flushed})
+}
+
+func list_cache_handler(w http.ResponseWriter, auth_handler *internal.AuthHandler) {
+	entries, err := auth_handler.ListCache()
+	if err != nil {
+		log.Printf("listing cache failed: %v", err)
+		write_json(w, http.StatusInternalServerError, map[string]string{"error": "listing cache failed"})
+		return
+	}
+	write_json(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+func evict_cache_handler(w http.ResponseWriter, r *http.Request, auth_handler *internal.AuthHandler) {
+	evicted, err := auth_handler.FlushCache(r.PathValue("user"))
+	if err != nil {
+		log.Printf("evicting cache entries failed: %v", err)
+		write_json(w, http.StatusInternalServerError, map[string]string{"error": "evicting cache entries failed"})
+		return
+	}
+	write_json(w, http.StatusOK, map[string]int{"evicted": evicted})
+}
+
+func reload_config_handler(w http.ResponseWriter, reload func() error) {
+	if err := reload(); err != nil {
+		log.Printf("reloading configuration failed: %v", err)
+		write_json(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	write_json(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func write_json(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
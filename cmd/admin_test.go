@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal"
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+const ADMIN_TOKEN = "secret"
+
+func TestFlushCacheOfUser(t *testing.T) {
+	validator_calls := 0
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		validator_calls++
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+	asserts.AssertEquals(t, 1, validator_calls)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("POST", "/cache/flush?user=other", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "{\"flushed\":0}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("POST", "/cache/flush?user=foo", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "{\"flushed\":1}\n", w.Body.String())
+
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+	asserts.AssertEquals(t, 2, validator_calls)
+}
+
+func TestFlushWholeCache(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("POST", "/cache/flush", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "{\"flushed\":1}\n", w.Body.String())
+}
+
+func TestFlushCacheRequiresPost(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("GET", "/cache/flush", nil))
+	asserts.AssertEquals(t, 405, w.Code)
+}
+
+func TestAdminApiRequiresToken(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, httptest.NewRequest("GET", "/cache", nil))
+	asserts.AssertEquals(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/cache", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	admin_handler.ServeHTTP(w, r)
+	asserts.AssertEquals(t, 401, w.Code)
+
+	// an empty token never matches
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/cache", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	create_admin_handler("", func() (*internal.AuthHandler, func()) { return &auth_handler, func() {} }, nil).ServeHTTP(w, r)
+	asserts.AssertEquals(t, 401, w.Code)
+}
+
+func TestListCache(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("GET", "/cache", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "application/json", w.Header().Get("Content-Type"))
+
+	var response struct {
+		Entries []internal.CacheEntryInfo `json:"entries"`
+	}
+	asserts.AssertNil(t, json.NewDecoder(w.Body).Decode(&response))
+	asserts.AssertEquals(t, 1, len(response.Entries))
+	asserts.AssertEquals(t, "foo", response.Entries[0].User)
+	asserts.AssertEquals(t, false, response.Entries[0].Negative)
+	asserts.AssertEquals(t, false, response.Entries[0].Expiry.IsZero())
+}
+
+func TestEvictCacheEntriesOfUser(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	admin_handler := createAdminHandler(&auth_handler, nil)
+	auth_handler.HandleAuthRequest(context.Background(), "imap", "foo", "bar", "127.0.0.1", 1)
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("DELETE", "/cache/foo", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "{\"evicted\":1}\n", w.Body.String())
+
+	entries, err := auth_handler.ListCache()
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 0, len(entries))
+}
+
+func TestReloadConfig(t *testing.T) {
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	reload_error := errors.New("broken configuration")
+	admin_handler := createAdminHandler(&auth_handler, func() error { return reload_error })
+
+	w := httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("POST", "/config/reload", nil))
+	asserts.AssertEquals(t, 500, w.Code)
+	asserts.AssertEquals(t, "{\"error\":\"broken configuration\"}\n", w.Body.String())
+
+	reload_error = nil
+	w = httptest.NewRecorder()
+	admin_handler.ServeHTTP(w, createAdminRequest("POST", "/config/reload", nil))
+	asserts.AssertEquals(t, 200, w.Code)
+}
+
+func TestReloadFunctionReplacesHandler(t *testing.T) {
+	config_file_path := filepath.Join(t.TempDir(), "config.yaml")
+	asserts.AssertNil(t, os.WriteFile(config_file_path, []byte("users: [foo]\nimap_host: imap.example.org\n"), 0600))
+
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	var current atomic.Pointer[internal.AuthHandler]
+	current.Store(&auth_handler)
+	reload := create_reload_function(config_file_path, &current)
+
+	asserts.AssertNil(t, reload())
+	asserts.AssertEquals(t, false, current.Load() == &auth_handler)
+	defer current.Load().Close()
+
+	// a broken configuration keeps the current handler
+	reloaded_handler := current.Load()
+	asserts.AssertNil(t, os.WriteFile(config_file_path, []byte("unknown_option: true\n"), 0600))
+	asserts.AssertNonNil(t, reload())
+	asserts.AssertEquals(t, true, current.Load() == reloaded_handler)
+}
+
+func TestReloadWaitsForRunningRequests(t *testing.T) {
+	config_file_path := filepath.Join(t.TempDir(), "config.yaml")
+	asserts.AssertNil(t, os.WriteFile(config_file_path, []byte("users: [foo]\nimap_host: imap.example.org\n"), 0600))
+
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
+	})
+	var current atomic.Pointer[internal.AuthHandler]
+	current.Store(&auth_handler)
+	reload := create_reload_function(config_file_path, &current)
+
+	acquired, release := acquire_handler(&current)
+	asserts.AssertEquals(t, true, acquired == &auth_handler)
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- reload()
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("the old handler was closed while a request was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the old handler is closed once the request has finished
+	release()
+	asserts.AssertNil(t, <-reloaded)
+	asserts.AssertEquals(t, false, auth_handler.Acquire())
+	defer current.Load().Close()
+	acquired, release = acquire_handler(&current)
+	defer release()
+	asserts.AssertEquals(t, true, acquired == current.Load())
+}
+
+func createAdminHandler(auth_handler *internal.AuthHandler, reload func() error) http.Handler {
+	return create_admin_handler(ADMIN_TOKEN, func() (*internal.AuthHandler, func()) { return auth_handler, func() {} }, reload)
+}
+
+func createAdminRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	r.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	return r
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/seiferma/nginxmailauthdelegator/internal"
 )
 
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatal("program arguments invalid. Configuration file has to be first argument.")
@@ -28,15 +37,109 @@ func main() {
 		os.Exit(1)
 	}
 
-	auth_handler := internal.CreateAuthHandler(config)
+	initial_handler, err := internal.CreateAuthHandler(config)
+	if err != nil {
+		log.Fatalf("the authentication handler could not be created: %v", err)
+		os.Exit(1)
+	}
+	var auth_handler atomic.Pointer[internal.AuthHandler]
+	auth_handler.Store(&initial_handler)
+
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("OK"))
 	})
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		ready_handler(w, auth_handler.Load())
+	})
 	http.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
-		http_handler(w, r, &auth_handler)
+		handler, release := acquire_handler(&auth_handler)
+		defer release()
+		http_handler(w, r, handler)
+	})
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		auth_handler.Load().Metrics().ServeHTTP(w, r)
 	})
+	if config.AdminAddress != "" {
+		if config.AdminToken == "" {
+			log.Fatal("the admin API requires an admin token.")
+			os.Exit(1)
+		}
+		reload := create_reload_function(config_file_path, &auth_handler)
+		admin_handler := create_admin_handler(config.AdminToken, func() (*internal.AuthHandler, func()) {
+			return acquire_handler(&auth_handler)
+		}, reload)
+		go func() {
+			log.Fatal(http.ListenAndServe(config.AdminAddress, admin_handler))
+		}()
+	}
+
+	// stop the cache sweeper and finish running requests on shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":8080"}
+	go func() {
+		<-ctx.Done()
+		shutdown_ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdown_ctx)
+	}()
+
 	log.Printf("Started")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	auth_handler.Load().Close()
+	log.Printf("Stopped")
+}
+
+// acquire_handler returns the current handler, which is not closed before the
+// returned release function is called. A handler that has been closed since
+// loading it has been replaced already, so the new one is used instead.
+func acquire_handler(auth_handler *atomic.Pointer[internal.AuthHandler]) (*internal.AuthHandler, func()) {
+	for {
+		handler := auth_handler.Load()
+		if handler.Acquire() {
+			return handler, handler.Release
+		}
+	}
+}
+
+// create_reload_function returns a function that loads the configuration file
+// again and replaces the authentication handler. Requests that are already
+// running finish with the old handler, which is closed afterwards. The listen
+// addresses and the admin token are not reloaded.
+func create_reload_function(config_file_path string, auth_handler *atomic.Pointer[internal.AuthHandler]) func() error {
+	var mutex sync.Mutex
+	return func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var config internal.Configuration
+		if err := config.Load(config_file_path); err != nil {
+			return err
+		}
+		new_handler, err := internal.CreateAuthHandler(config)
+		if err != nil {
+			return err
+		}
+		auth_handler.Swap(&new_handler).Close()
+		log.Printf("Configuration reloaded")
+		return nil
+	}
+}
+
+// ready_handler reports the instance as unavailable while no IMAP upstream can
+// be reached, so that a load balancer may prefer other instances.
+func ready_handler(w http.ResponseWriter, auth_handler *internal.AuthHandler) {
+	ready, open_upstreams := auth_handler.Ready()
+	if open_upstreams == nil {
+		open_upstreams = []string{}
+	}
+	if !ready {
+		write_json(w, http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "open_circuits": open_upstreams})
+		return
+	}
+	write_json(w, http.StatusOK, map[string]any{"status": "ready", "open_circuits": open_upstreams})
 }
 
 func http_handler(w http.ResponseWriter, r *http.Request, auth_handler *internal.AuthHandler) {
@@ -74,7 +177,7 @@ func http_handler(w http.ResponseWriter, r *http.Request, auth_handler *internal
 	auth_user := r.Header.Get("Auth-User")
 	auth_pass := r.Header.Get("Auth-Pass")
 
-	auth_response := auth_handler.HandleAuthRequest(auth_protocol, auth_user, auth_pass, auth_attempt)
+	auth_response := auth_handler.HandleAuthRequest(r.Context(), auth_protocol, auth_user, auth_pass, client_ip, auth_attempt)
 
 	if auth_response.Status == "OK" {
 		if client_ip != "" {
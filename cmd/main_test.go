@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -14,8 +16,8 @@ import (
 func TestInvalidRequestMissingAttempts(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 	r.Header.Del("Auth-Login-Attempt")
 
@@ -28,8 +30,8 @@ func TestInvalidRequestMissingAttempts(t *testing.T) {
 func TestInvalidRequestMissingClientIp(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 	r.Header.Del("Client-IP")
 
@@ -42,8 +44,8 @@ func TestInvalidRequestMissingClientIp(t *testing.T) {
 func TestInvalidRequestMissingProtocol(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 	r.Header.Del("Auth-Protocol")
 
@@ -56,8 +58,8 @@ func TestInvalidRequestMissingProtocol(t *testing.T) {
 func TestInvalidRequestUnsupportedMethod(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "cram-md5", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
@@ -69,8 +71,8 @@ func TestInvalidRequestUnsupportedMethod(t *testing.T) {
 func TestInvalidRequestUsingMutualTls(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 	r.Header.Add("Auth-SSL-Verify", "SUCCESS")
 
@@ -83,8 +85,8 @@ func TestInvalidRequestUsingMutualTls(t *testing.T) {
 func TestInvalidSmtpCredentialsAuthRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
@@ -94,11 +96,30 @@ func TestInvalidSmtpCredentialsAuthRequest(t *testing.T) {
 	asserts.AssertEquals(t, "2", w.Header().Get("Auth-Wait"))
 }
 
+func TestUpstreamTimeoutAuthRequest(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		// nginx gives up while the upstream does not answer
+		cancel()
+		asserts.AssertNonNil(t, ctx.Err())
+		return internal.ValidationResult{Decision: false, Valid: false, Timeout: true}
+	})
+
+	http_handler(w, r, &auth_handler)
+
+	asserts.AssertEquals(t, "Temporary server problem, try again later", w.Header().Get("Auth-Status"))
+	asserts.AssertEquals(t, "454 4.7.0", w.Header().Get("Auth-Error-Code"))
+	asserts.AssertEquals(t, "2", w.Header().Get("Auth-Wait"))
+}
+
 func TestInvalidImapCredentialsAuthRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "imap", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
@@ -111,8 +132,8 @@ func TestInvalidImapCredentialsAuthRequest(t *testing.T) {
 func TestInvalidCredentialsTooManyTriesAuthRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(3, "plain", "imap", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
@@ -124,14 +145,14 @@ func TestInvalidCredentialsTooManyTriesAuthRequest(t *testing.T) {
 func TestValidImapCredentialsAuthRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "imap", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return true, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
 
 	asserts.AssertEquals(t, "OK", w.Header().Get("Auth-Status"))
-	asserts.AssertEquals(t, "imap.example.org", w.Header().Get("Auth-Server"))
+	asserts.AssertEquals(t, "192.0.2.10", w.Header().Get("Auth-Server"))
 	asserts.AssertEquals(t, "993", w.Header().Get("Auth-Port"))
 	asserts.AssertEquals(t, "", w.Header().Get("Auth-User"))
 	asserts.AssertEquals(t, "", w.Header().Get("Auth-Pass"))
@@ -140,14 +161,14 @@ func TestValidImapCredentialsAuthRequest(t *testing.T) {
 func TestValidImtpCredentialsAuthRequest(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := createRequest(1, "plain", "smtp", "foo", "bar", "127.0.0.1")
-	auth_handler := createAuthHandler(func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return true, true
+	auth_handler := createAuthHandler(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: true, Valid: true}
 	})
 
 	http_handler(w, r, &auth_handler)
 
 	asserts.AssertEquals(t, "OK", w.Header().Get("Auth-Status"))
-	asserts.AssertEquals(t, "smtp.example.org", w.Header().Get("Auth-Server"))
+	asserts.AssertEquals(t, "192.0.2.25", w.Header().Get("Auth-Server"))
 	asserts.AssertEquals(t, "587", w.Header().Get("Auth-Port"))
 	asserts.AssertEquals(t, "qq", w.Header().Get("Auth-User"))
 	asserts.AssertEquals(t, "pp", w.Header().Get("Auth-Pass"))
@@ -162,7 +183,32 @@ func createAuthHandler(imapValidator internal.ImapValidator) internal.AuthHandle
 		SmtpPass:         "pp",
 	}
 	cache_entry_validity, _ := time.ParseDuration("3s")
-	return internal.CreateAuthHandlerWithCustomCallbacks(cfg, imapValidator, cache_entry_validity)
+	auth_handler, err := internal.CreateAuthHandlerWithCustomCallbacks(cfg, imapValidator, fakeResolver{}, cache_entry_validity)
+	if err != nil {
+		panic(err)
+	}
+	return auth_handler
+}
+
+// fakeResolver only resolves the upstreams of the test configuration
+type fakeResolver struct{}
+
+func (fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	switch host {
+	case "imap.example.org":
+		return []net.IP{net.ParseIP("192.0.2.10")}, nil
+	case "smtp.example.org":
+		return []net.IP{net.ParseIP("192.0.2.25")}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
 }
 
 func createRequest(attempt int, method, protocol, user, password, client_ip string) *http.Request {
@@ -181,3 +227,28 @@ func addHeaderIfNotEmpty(r *http.Request, name, value string) {
 		r.Header.Add(name, value)
 	}
 }
+
+func TestReadyRequest(t *testing.T) {
+	cfg := internal.Configuration{
+		WhitelistedUsers:           []string{"foo"},
+		ImapServer:                 "imap.example.org",
+		CircuitBreakerThreshold:    1,
+		CircuitBreakerOpenDuration: time.Minute,
+	}
+	auth_handler, err := internal.CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings internal.ImapTlsSettings) internal.ValidationResult {
+		return internal.ValidationResult{Decision: false, Valid: false}
+	}, fakeResolver{}, time.Minute)
+	asserts.AssertNil(t, err)
+
+	w := httptest.NewRecorder()
+	ready_handler(w, &auth_handler)
+	asserts.AssertEquals(t, 200, w.Code)
+	asserts.AssertEquals(t, "{\"open_circuits\":[],\"status\":\"ready\"}\n", w.Body.String())
+
+	http_handler(httptest.NewRecorder(), createRequest(1, "plain", "imap", "foo", "bar", "127.0.0.1"), &auth_handler)
+
+	w = httptest.NewRecorder()
+	ready_handler(w, &auth_handler)
+	asserts.AssertEquals(t, 503, w.Code)
+	asserts.AssertEquals(t, "{\"open_circuits\":[\"imap.example.org:993\"],\"status\":\"unavailable\"}\n", w.Body.String())
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	IP_PREFERENCE_IPV4 = "ipv4"
+	IP_PREFERENCE_IPV6 = "ipv6"
+
+	ADDRESS_RESOLUTION_TIMEOUT = 5 * time.Second
+	ADDRESS_PROBE_TIMEOUT      = time.Second
+)
+
+type resolvedAddresses struct {
+	ips    []net.IP
+	expiry time.Time
+}
+
+type addressHealth struct {
+	healthy bool
+	expiry  time.Time
+}
+
+// addressResolver resolves the hostnames of upstreams to IP addresses, because
+// nginx only accepts IP addresses as Auth-Server. Addresses and their health are
+// cached for ttl. If a hostname has several addresses, the first reachable one
+// in order of the preferred IP version is used.
+type addressResolver struct {
+	resolver    Resolver
+	ttl         time.Duration
+	prefer_ipv6 bool
+	probe       func(address string) bool
+	mutex       sync.Mutex
+	addresses   map[string]resolvedAddresses
+	health      map[string]addressHealth
+}
+
+func createAddressResolver(resolver Resolver, ttl time.Duration, ip_preference string) (*addressResolver, error) {
+	if ttl == 0 {
+		ttl = DEFAULT_DNS_CACHE_TTL
+	}
+
+	address_resolver := &addressResolver{
+		resolver:  resolver,
+		ttl:       ttl,
+		probe:     isAddressReachable,
+		addresses: make(map[string]resolvedAddresses),
+		health:    make(map[string]addressHealth),
+	}
+	switch ip_preference {
+	case "", IP_PREFERENCE_IPV4:
+	case IP_PREFERENCE_IPV6:
+		address_resolver.prefer_ipv6 = true
+	default:
+		return nil, fmt.Errorf("unsupported ip preference %q", ip_preference)
+	}
+	return address_resolver, nil
+}
+
+// resolve returns the IP address nginx should connect to.
+func (resolver *addressResolver) resolve(host string, port int) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	if host == "" {
+		return "", fmt.Errorf("no host to resolve")
+	}
+
+	ips, err := resolver.lookup(host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) > 1 {
+		for _, ip := range ips {
+			if resolver.isHealthy(net.JoinHostPort(ip.String(), strconv.Itoa(port))) {
+				return ip.String(), nil
+			}
+		}
+	}
+	// nginx reports the failure to the client if no address is reachable
+	return ips[0].String(), nil
+}
+
+func (resolver *addressResolver) lookup(host string) ([]net.IP, error) {
+	resolver.mutex.Lock()
+	addresses, found := resolver.addresses[host]
+	resolver.mutex.Unlock()
+	if found && time.Now().Before(addresses.expiry) {
+		return addresses.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ADDRESS_RESOLUTION_TIMEOUT)
+	defer cancel()
+	ips, err := resolver.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %v failed: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %v", host)
+	}
+
+	ips = slices.Clone(ips)
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return resolver.familyRank(a) - resolver.familyRank(b)
+	})
+
+	resolver.mutex.Lock()
+	resolver.addresses[host] = resolvedAddresses{ips: ips, expiry: time.Now().Add(resolver.ttl)}
+	resolver.mutex.Unlock()
+	return ips, nil
+}
+
+// return: int (0 for the preferred IP version, 1 otherwise)
+func (resolver *addressResolver) familyRank(ip net.IP) int {
+	if (ip.To4() == nil) == resolver.prefer_ipv6 {
+		return 0
+	}
+	return 1
+}
+
+func (resolver *addressResolver) isHealthy(address string) bool {
+	resolver.mutex.Lock()
+	health, found := resolver.health[address]
+	resolver.mutex.Unlock()
+	if found && time.Now().Before(health.expiry) {
+		return health.healthy
+	}
+
+	healthy := resolver.probe(address)
+	resolver.mutex.Lock()
+	resolver.health[address] = addressHealth{healthy: healthy, expiry: time.Now().Add(resolver.ttl)}
+	resolver.mutex.Unlock()
+	return healthy
+}
+
+func isAddressReachable(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, ADDRESS_PROBE_TIMEOUT)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestResolveIpLiteral(t *testing.T) {
+	resolver := createTestAddressResolver(t, IP_PREFERENCE_IPV4)
+	ip, err := resolver.resolve("192.0.2.100", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.100", ip)
+	ip, err = resolver.resolve("2001:db8::100", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "2001:db8::100", ip)
+}
+
+func TestResolvePreferredIpVersion(t *testing.T) {
+	resolver := createTestAddressResolver(t, IP_PREFERENCE_IPV4)
+	ip, err := resolver.resolve("dualstack.example.org", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.1", ip)
+
+	resolver = createTestAddressResolver(t, IP_PREFERENCE_IPV6)
+	ip, err = resolver.resolve("dualstack.example.org", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "2001:db8::1", ip)
+}
+
+func TestUnsupportedIpPreference(t *testing.T) {
+	_, err := createAddressResolver(createFakeResolver(), time.Minute, "ipv5")
+	asserts.AssertNonNil(t, err)
+}
+
+func TestResolveSkipsUnreachableAddresses(t *testing.T) {
+	resolver := createTestAddressResolver(t, IP_PREFERENCE_IPV4)
+	var probed []string
+	resolver.probe = func(address string) bool {
+		probed = append(probed, address)
+		return address != "192.0.2.2:993"
+	}
+
+	ip, err := resolver.resolve("multi.example.org", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.3", ip)
+
+	// the health is cached
+	ip, err = resolver.resolve("multi.example.org", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.3", ip)
+	asserts.AssertStringArraysEquals(t, []string{"192.0.2.2:993", "192.0.2.3:993"}, probed)
+
+	// the first address is used if none is reachable
+	resolver.probe = func(address string) bool { return false }
+	ip, err = resolver.resolve("multi.example.org", 587)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.2", ip)
+}
+
+func TestResolveSingleAddressWithoutProbe(t *testing.T) {
+	resolver := createTestAddressResolver(t, IP_PREFERENCE_IPV4)
+	resolver.probe = func(address string) bool {
+		t.Fatal("should not be called")
+		return false
+	}
+	ip, err := resolver.resolve("imap.example.org", 993)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "192.0.2.10", ip)
+}
+
+func TestResolvedAddressesAreCached(t *testing.T) {
+	fake_resolver := createFakeResolver()
+	resolver, err := createAddressResolver(fake_resolver, 50*time.Millisecond, IP_PREFERENCE_IPV4)
+	asserts.AssertNil(t, err)
+
+	resolver.resolve("imap.example.org", 993)
+	resolver.resolve("imap.example.org", 993)
+	asserts.AssertEquals(t, 1, fake_resolver.lookups)
+
+	time.Sleep(100 * time.Millisecond)
+	resolver.resolve("imap.example.org", 993)
+	asserts.AssertEquals(t, 2, fake_resolver.lookups)
+}
+
+func TestResolveFails(t *testing.T) {
+	resolver := createTestAddressResolver(t, IP_PREFERENCE_IPV4)
+	_, err := resolver.resolve("unknown.example.org", 993)
+	asserts.AssertNonNil(t, err)
+	_, err = resolver.resolve("", 993)
+	asserts.AssertNonNil(t, err)
+}
+
+func TestUnresolvableUpstreamCausesTemporaryFailure(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	handler.default_route.smtp_host = "unknown.example.org"
+
+	response := handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Temporary server problem, try again later", response.Status)
+	asserts.AssertEquals(t, "454 4.7.0", response.Error_code)
+	asserts.AssertEquals(t, 2, response.Wait)
+	asserts.AssertEquals(t, "", response.Server)
+}
+
+func createTestAddressResolver(t *testing.T, ip_preference string) *addressResolver {
+	resolver, err := createAddressResolver(createFakeResolver(), time.Minute, ip_preference)
+	asserts.AssertNil(t, err)
+	return resolver
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CACHE_STORE_MEMORY = "memory"
+	CACHE_STORE_FILE   = "file"
+	CACHE_STORE_REDIS  = "redis"
+
+	// reject credentials that do not match the cached ones
+	CACHE_MISMATCH_REJECT = "reject"
+	// validate credentials that do not match the cached ones at the backends
+	CACHE_MISMATCH_REVALIDATE = "revalidate"
+
+	// entries expire after a fixed time
+	CACHE_EXPIRY_ABSOLUTE = "absolute"
+	// the expiry of an entry is renewed whenever it is used
+	CACHE_EXPIRY_SLIDING = "sliding"
+)
+
+// cachePolicy defines how long authentications are cached. A validity of zero
+// disables caching of successful or failed authentications respectively.
+type cachePolicy struct {
+	validity          time.Duration
+	negative_validity time.Duration
+	sliding_expiry    bool
+}
+
+// authCacheEntry is either a successful authentication stored under the username
+// or a failed authentication (negative) stored under a key derived from the
+// username and the failed password.
+type authCacheEntry struct {
+	username      string
+	password_hash []byte
+	expiry        time.Time
+	server        string
+	port          int
+	upstream_user string
+	negative      bool
+}
+
+// removalTime returns when the entry is not of use anymore. Successful
+// authentications are kept for stale_grace after their expiry, so that they can
+// be used while the backends are unreachable.
+func (entry authCacheEntry) removalTime(stale_grace time.Duration) time.Time {
+	if entry.negative {
+		return entry.expiry
+	}
+	return entry.expiry.Add(stale_grace)
+}
+
+// authCache stores authentications by key. Implementations have to be safe for
+// concurrent use.
+type authCache interface {
+	get(key string) (authCacheEntry, bool)
+	put(key string, entry authCacheEntry) error
+	delete(key string) error
+	// deleteAll removes the entries of all keys at once
+	deleteAll(keys []string) error
+	list() (map[string]authCacheEntry, error)
+	// close releases the connections of the store
+	close() error
+}
+
+// return: cachePolicy (default), map[string]cachePolicy (per user)
+func createCachePolicies(cfg Configuration, cache_entry_validity time.Duration) (cachePolicy, map[string]cachePolicy, error) {
+	default_policy := cachePolicy{
+		validity:          cache_entry_validity,
+		negative_validity: cfg.CacheNegativeTtl,
+	}
+	sliding_expiry, err := isSlidingExpiry(cfg.CacheExpiry)
+	if err != nil {
+		return cachePolicy{}, nil, err
+	}
+	default_policy.sliding_expiry = sliding_expiry
+
+	user_policies := make(map[string]cachePolicy)
+	for user, override := range cfg.CacheUserOverrides {
+		user_policy := default_policy
+		if override.Ttl != nil {
+			user_policy.validity = *override.Ttl
+		}
+		if override.NegativeTtl != nil {
+			user_policy.negative_validity = *override.NegativeTtl
+		}
+		if override.Expiry != "" {
+			if user_policy.sliding_expiry, err = isSlidingExpiry(override.Expiry); err != nil {
+				return cachePolicy{}, nil, err
+			}
+		}
+		user_policies[user] = user_policy
+	}
+
+	return default_policy, user_policies, nil
+}
+
+func isCacheRevalidatedOnMismatch(mismatch string) (bool, error) {
+	switch mismatch {
+	case "", CACHE_MISMATCH_REJECT:
+		return false, nil
+	case CACHE_MISMATCH_REVALIDATE:
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported cache mismatch policy %q", mismatch)
+}
+
+func isSlidingExpiry(expiry string) (bool, error) {
+	switch expiry {
+	case "", CACHE_EXPIRY_ABSOLUTE:
+		return false, nil
+	case CACHE_EXPIRY_SLIDING:
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported cache expiry %q", expiry)
+}
+
+// createNegativeCacheSecret returns the configured key of failed
+// authentications or a random one, which is only known to this process.
+func createNegativeCacheSecret(cfg Configuration) ([]byte, error) {
+	if cfg.CacheNegativeSecret != "" {
+		return []byte(cfg.CacheNegativeSecret), nil
+	}
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// negativeCacheKey derives the key of a failed authentication. The password is
+// only used in an HMAC keyed by secret, so that failed passwords, which are
+// often typos of the real one, cannot be guessed from the file or redis store.
+func negativeCacheKey(secret []byte, user string, pass []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write(pass)
+	return user + "\x00" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func createAuthCache(cfg Configuration, metrics *Metrics) (authCache, error) {
+	evictions := metrics.Counter(`cache_evictions_total{reason="capacity"}`, "Number of cache entries removed.")
+	switch cfg.CacheStore {
+	case "", CACHE_STORE_MEMORY:
+		cache := createMemoryAuthCache(cfg.CacheMaxEntries, evictions)
+		metrics.Gauge("cache_entries", "Number of cached entries.", cache.size)
+		return cache, nil
+	case CACHE_STORE_FILE:
+		cache, err := createFileAuthCache(cfg.CacheFile, cfg.CacheMaxEntries, cfg.CacheStaleGrace, evictions)
+		if err != nil {
+			return nil, err
+		}
+		metrics.Gauge("cache_entries", "Number of cached entries.", cache.size)
+		return cache, nil
+	case CACHE_STORE_REDIS:
+		if cfg.CacheMaxEntries > 0 {
+			return nil, fmt.Errorf("the redis cache store does not support a maximum number of entries")
+		}
+		return createRedisAuthCache(cfg.CacheRedisAddress, cfg.CacheRedisPassword, cfg.CacheRedisDb, cfg.CacheRedisKeyPrefix, cfg.CacheStaleGrace), nil
+	}
+	return nil, fmt.Errorf("unsupported cache store %q", cfg.CacheStore)
+}
+
+// memoryAuthCache evicts the entry expiring next if it holds max_entries
+// entries already. A max_entries of zero means unbounded.
+type memoryAuthCache struct {
+	mutex       sync.RWMutex
+	entries     map[string]authCacheEntry
+	max_entries int
+	evictions   *atomic.Uint64
+}
+
+func createMemoryAuthCache(max_entries int, evictions *atomic.Uint64) *memoryAuthCache {
+	return &memoryAuthCache{
+		entries:     make(map[string]authCacheEntry),
+		max_entries: max_entries,
+		evictions:   evictions,
+	}
+}
+
+func (cache *memoryAuthCache) get(key string) (authCacheEntry, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	entry, found := cache.entries[key]
+	return entry, found
+}
+
+func (cache *memoryAuthCache) put(key string, entry authCacheEntry) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.putLocked(key, entry)
+	return nil
+}
+
+// putLocked has to be called while holding the mutex
+func (cache *memoryAuthCache) putLocked(key string, entry authCacheEntry) {
+	_, replaced := cache.entries[key]
+	if !replaced && cache.max_entries > 0 && len(cache.entries) >= cache.max_entries {
+		evicted_key := ""
+		var evicted_expiry time.Time
+		for other_key, other_entry := range cache.entries {
+			if evicted_key == "" || other_entry.expiry.Before(evicted_expiry) {
+				evicted_key, evicted_expiry = other_key, other_entry.expiry
+			}
+		}
+		delete(cache.entries, evicted_key)
+		cache.evictions.Add(1)
+	}
+	cache.entries[key] = entry
+}
+
+func (cache *memoryAuthCache) delete(key string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, key)
+	return nil
+}
+
+func (cache *memoryAuthCache) deleteAll(keys []string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, key := range keys {
+		delete(cache.entries, key)
+	}
+	return nil
+}
+
+func (cache *memoryAuthCache) close() error {
+	return nil
+}
+
+func (cache *memoryAuthCache) size() float64 {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return float64(len(cache.entries))
+}
+
+func (cache *memoryAuthCache) list() (map[string]authCacheEntry, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return maps.Clone(cache.entries), nil
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestMemoryAuthCache(t *testing.T) {
+	cache := createMemoryAuthCache(0, &atomic.Uint64{})
+
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now()}))
+	entry, found := cache.get("test")
+	asserts.AssertEquals(t, true, found)
+	asserts.AssertEquals(t, "hash", string(entry.password_hash))
+
+	asserts.AssertNil(t, cache.delete("test"))
+	_, found = cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestCreateUnsupportedAuthCache(t *testing.T) {
+	_, err := createAuthCache(Configuration{CacheStore: "foo"}, CreateMetrics())
+	asserts.AssertNonNil(t, err)
+}
+
+func TestCachePolicies(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_cache.yaml")
+	asserts.AssertNil(t, err)
+
+	default_policy, user_policies, err := createCachePolicies(cfg, *cfg.CacheTtl)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, cachePolicy{validity: time.Hour, negative_validity: 30 * time.Second, sliding_expiry: true}, default_policy)
+	asserts.AssertEquals(t, cachePolicy{validity: 0, negative_validity: 30 * time.Second, sliding_expiry: true}, user_policies["some_user"])
+	asserts.AssertEquals(t, cachePolicy{validity: time.Hour, negative_validity: time.Minute, sliding_expiry: false}, user_policies["other_user"])
+}
+
+func TestUnsupportedCacheExpiry(t *testing.T) {
+	_, _, err := createCachePolicies(Configuration{CacheExpiry: "foo"}, time.Minute)
+	asserts.AssertNonNil(t, err)
+}
+
+func TestNegativeCacheKeyDependsOnPassword(t *testing.T) {
+	secret := []byte("secret")
+	asserts.AssertEquals(t, negativeCacheKey(secret, "test", []byte("pass")), negativeCacheKey(secret, "test", []byte("pass")))
+	asserts.AssertNotEquals(t, negativeCacheKey(secret, "test", []byte("pass")), negativeCacheKey(secret, "test", []byte("pass2")))
+	asserts.AssertNotEquals(t, negativeCacheKey(secret, "test", []byte("pass")), negativeCacheKey(secret, "test2", []byte("pass")))
+}
+
+func TestNegativeCacheKeyDependsOnSecret(t *testing.T) {
+	asserts.AssertNotEquals(t, negativeCacheKey([]byte("secret"), "test", []byte("pass")), negativeCacheKey([]byte("other"), "test", []byte("pass")))
+
+	configured, err := createNegativeCacheSecret(Configuration{CacheNegativeSecret: "secret"})
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "secret", string(configured))
+
+	random, err := createNegativeCacheSecret(Configuration{})
+	asserts.AssertNil(t, err)
+	other_random, err := createNegativeCacheSecret(Configuration{})
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 32, len(random))
+	asserts.AssertNotEquals(t, string(random), string(other_random))
+}
+
+func TestMemoryAuthCacheEvictsEntryExpiringNext(t *testing.T) {
+	evictions := &atomic.Uint64{}
+	cache := createMemoryAuthCache(2, evictions)
+
+	now := time.Now()
+	asserts.AssertNil(t, cache.put("a", authCacheEntry{username: "a", expiry: now.Add(2 * time.Minute)}))
+	asserts.AssertNil(t, cache.put("b", authCacheEntry{username: "b", expiry: now.Add(time.Minute)}))
+	// replacing an entry does not evict anything
+	asserts.AssertNil(t, cache.put("a", authCacheEntry{username: "a", expiry: now.Add(3 * time.Minute)}))
+	asserts.AssertEquals(t, uint64(0), evictions.Load())
+
+	asserts.AssertNil(t, cache.put("c", authCacheEntry{username: "c", expiry: now.Add(time.Minute)}))
+	asserts.AssertEquals(t, uint64(1), evictions.Load())
+	_, found := cache.get("b")
+	asserts.AssertEquals(t, false, found)
+	_, found = cache.get("a")
+	asserts.AssertEquals(t, true, found)
+	_, found = cache.get("c")
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestRedisAuthCacheWithMaxEntries(t *testing.T) {
+	_, err := createAuthCache(Configuration{CacheStore: CACHE_STORE_REDIS, CacheMaxEntries: 10}, CreateMetrics())
+	asserts.AssertNonNil(t, err)
+}
+
+func TestCacheEntriesGauge(t *testing.T) {
+	metrics := CreateMetrics()
+	cache, err := createAuthCache(Configuration{CacheStore: CACHE_STORE_MEMORY}, metrics)
+	asserts.AssertNil(t, err)
+	asserts.AssertNil(t, cache.put("a", authCacheEntry{username: "a", expiry: time.Now().Add(time.Minute)}))
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	asserts.AssertEquals(t, true, strings.Contains(w.Body.String(), "nginxmailauthdelegator_cache_entries 1\n"))
+}
@@ -1,39 +1,58 @@
 package internal
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
+	"errors"
+	"io"
+	"log"
 	"net"
-	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap/client"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const MAX_RETRIES = 3
 
-type authCacheEntry struct {
-	username      string
-	password_hash []byte
-	expiry        time.Time
-}
-
-type ImapValidator func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool)
+// ImapValidator validates credentials at an IMAP server. It gives up once ctx is
+// done or the timeouts of tls_settings are exceeded.
+type ImapValidator func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult
 
 type AuthHandler struct {
 	valid_usernames      []string
-	auth_cache           map[string]authCacheEntry
-	cache_entry_validity time.Duration
-	imap_host            string
-	imap_port            int
-	ca_cert_file         string
-	smtp_host            string
-	smtp_user            string
-	smtp_password        string
-	imap_validator       ImapValidator
+	user_rewriter        *userRewriter
+	auth_cache           authCache
+	cache_policy         cachePolicy
+	cache_user_policies  map[string]cachePolicy
+	negative_secret      []byte
+	cache_revalidate     bool
+	cache_stale_grace    time.Duration
+	cache_revalidator    *cacheRevalidator
+	stale_hits           *atomic.Uint64
+	revalidations        *atomic.Uint64
+	password_hasher      passwordHasher
+	cache_sweeper        *cacheSweeper
+	expired_evictions    *atomic.Uint64
+	metrics              *Metrics
+	default_route        *authRoute
+	address_resolver     *addressResolver
+	routes               []*authRoute
+	imap_connection_pool *imapConnectionPool
+	circuit_breakers     *circuitBreakers
+	requests             *runningRequests
+}
+
+// runningRequests tracks the requests using a handler, so that its connections
+// are only closed once they have finished.
+type runningRequests struct {
+	mutex   sync.Mutex
+	closed  bool
+	running sync.WaitGroup
 }
 
 type AuthResponse struct {
@@ -46,27 +65,175 @@ type AuthResponse struct {
 	Port       int
 }
 
-func CreateAuthHandler(cfg Configuration) AuthHandler {
-	cache_entry_validity, _ := time.ParseDuration("15m")
-	return CreateAuthHandlerWithCustomCallbacks(cfg, credentialsValidInImap, cache_entry_validity)
+func CreateAuthHandler(cfg Configuration) (AuthHandler, error) {
+	var cache_ttl time.Duration
+	if cfg.CacheTtl != nil {
+		cache_ttl = *cfg.CacheTtl
+	}
+	if cfg.ImapPoolSize <= 0 {
+		return CreateAuthHandlerWithCustomCallbacks(cfg, credentialsValidInImap, net.DefaultResolver, cache_ttl)
+	}
+	imap_connection_pool := createImapConnectionPool(cfg.ImapPoolSize, cfg.ImapPoolMaxIdle)
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, imap_connection_pool.validate, net.DefaultResolver, cache_ttl)
+	if err != nil {
+		imap_connection_pool.Close()
+		return AuthHandler{}, err
+	}
+	handler.imap_connection_pool = imap_connection_pool
+	return handler, nil
 }
 
-func CreateAuthHandlerWithCustomCallbacks(cfg Configuration, imap_validator ImapValidator, cache_entry_validity time.Duration) AuthHandler {
+func CreateAuthHandlerWithCustomCallbacks(cfg Configuration, imap_validator ImapValidator, resolver Resolver, cache_entry_validity time.Duration) (AuthHandler, error) {
+	metrics := CreateMetrics()
+	var circuit_breakers *circuitBreakers
+	if cfg.CircuitBreakerThreshold > 0 {
+		circuit_breakers = createCircuitBreakers(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerOpenDuration, metrics)
+		imap_validator = circuit_breakers.wrap(imap_validator)
+	}
+	address_resolver, err := createAddressResolver(resolver, cfg.DnsCacheTtl, cfg.IpPreference)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	cache_policy, cache_user_policies, err := createCachePolicies(cfg, cache_entry_validity)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	cache_revalidate, err := isCacheRevalidatedOnMismatch(cfg.CacheMismatch)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	password_hasher, err := createPasswordHasher(cfg)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	negative_secret, err := createNegativeCacheSecret(cfg)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	user_rewriter, err := createUserRewriter(cfg)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+
+	// routes and cache hold connections, so they are created last and released
+	// if the configuration turns out to be invalid
+	default_route, routes, err := createRoutes(cfg, imap_validator, resolver, metrics)
+	if err != nil {
+		return AuthHandler{}, err
+	}
+	auth_cache, err := createAuthCache(cfg, metrics)
+	if err != nil {
+		stopRoutes(default_route, routes)
+		return AuthHandler{}, err
+	}
+
+	// entries in redis expire by themselves
+	expired_evictions := metrics.Counter(`cache_evictions_total{reason="expired"}`, "Number of cache entries removed.")
+	var cache_sweeper *cacheSweeper
+	if cfg.CacheSweepInterval != nil && *cfg.CacheSweepInterval > 0 && cfg.CacheStore != CACHE_STORE_REDIS {
+		cache_sweeper = startCacheSweeper(auth_cache, *cfg.CacheSweepInterval, cfg.CacheStaleGrace, expired_evictions)
+	}
+	var cache_revalidator *cacheRevalidator
+	if cfg.CacheStaleGrace > 0 && cfg.CacheStaleRevalidateInterval > 0 {
+		cache_revalidator = createCacheRevalidator(cfg.CacheStaleRevalidateInterval)
+	}
+	for _, route := range append([]*authRoute{default_route}, routes...) {
+		if cfg.ImapHealthCheckInterval > 0 && len(route.imap_upstreams.upstreams) > 1 {
+			route.imap_upstreams.startHealthChecks(cfg.ImapHealthCheckInterval, isImapUpstreamReachable)
+		}
+	}
+
 	return AuthHandler{
-		valid_usernames:      cfg.WhitelistedUsers,
-		imap_host:            cfg.ImapServer,
-		imap_port:            cfg.ImapPort,
-		ca_cert_file:         cfg.CaCertFile,
-		imap_validator:       imap_validator,
-		smtp_host:            cfg.SmtpServer,
-		smtp_user:            cfg.SmtpUser,
-		smtp_password:        cfg.SmtpPass,
-		cache_entry_validity: cache_entry_validity,
-		auth_cache:           make(map[string]authCacheEntry),
+		valid_usernames:     cfg.WhitelistedUsers,
+		user_rewriter:       user_rewriter,
+		default_route:       default_route,
+		address_resolver:    address_resolver,
+		routes:              routes,
+		cache_policy:        cache_policy,
+		cache_user_policies: cache_user_policies,
+		negative_secret:     negative_secret,
+		cache_revalidate:    cache_revalidate,
+		cache_stale_grace:   cfg.CacheStaleGrace,
+		cache_revalidator:   cache_revalidator,
+		stale_hits:          metrics.Counter("cache_stale_hits_total", "Number of logins accepted by expired cache entries while the backends could not decide."),
+		revalidations:       metrics.Counter("cache_revalidations_total", "Number of expired cache entries revalidated in the background."),
+		password_hasher:     password_hasher,
+		cache_sweeper:       cache_sweeper,
+		expired_evictions:   expired_evictions,
+		metrics:             metrics,
+		auth_cache:          auth_cache,
+		circuit_breakers:    circuit_breakers,
+		requests:            &runningRequests{},
+	}, nil
+}
+
+// Acquire registers a request using the handler. Close waits until the request
+// calls Release.
+// return: false if the handler has been closed already
+func (handler *AuthHandler) Acquire() bool {
+	handler.requests.mutex.Lock()
+	defer handler.requests.mutex.Unlock()
+	if handler.requests.closed {
+		return false
+	}
+	handler.requests.running.Add(1)
+	return true
+}
+
+// Release marks a request registered via Acquire as finished.
+func (handler *AuthHandler) Release() {
+	handler.requests.running.Done()
+}
+
+// Close waits for the acquired requests, stops all background tasks of the
+// handler and closes the connections of its backends and cache.
+func (handler *AuthHandler) Close() {
+	handler.requests.mutex.Lock()
+	handler.requests.closed = true
+	handler.requests.mutex.Unlock()
+	handler.requests.running.Wait()
+
+	if handler.cache_sweeper != nil {
+		handler.cache_sweeper.Stop()
+	}
+	if handler.cache_revalidator != nil {
+		handler.cache_revalidator.Stop()
+	}
+	stopRoutes(handler.default_route, handler.routes)
+	if handler.imap_connection_pool != nil {
+		handler.imap_connection_pool.Close()
+	}
+	if err := handler.auth_cache.close(); err != nil {
+		log.Printf("closing cache failed: %v", err)
+	}
+}
+
+// Ready tells if the handler can currently reach any IMAP upstream. It is not
+// ready while the circuits of all upstreams are open.
+// return: bool (ready), []string (upstreams with open circuit)
+func (handler *AuthHandler) Ready() (bool, []string) {
+	if handler.circuit_breakers == nil {
+		return true, nil
 	}
+	return !handler.circuit_breakers.allOpen(), handler.circuit_breakers.openUpstreams()
 }
 
-func (handler *AuthHandler) HandleAuthRequest(protocol, user, pass string, attempt int) AuthResponse {
+// Metrics returns the metrics collected by the handler.
+func (handler *AuthHandler) Metrics() *Metrics {
+	return handler.metrics
+}
+
+// HandleAuthRequest validates the credentials and returns the upstream nginx
+// should connect to. Validation is canceled once ctx is done.
+func (handler *AuthHandler) HandleAuthRequest(ctx context.Context, protocol, user, pass, client_ip string, attempt int) AuthResponse {
+
+	// whitelist, cache, routes and backends only see the canonical name
+	user = handler.user_rewriter.rewrite(user)
 
 	// only proceed if username is whitelisted
 	if !contains(handler.valid_usernames, user) {
@@ -74,19 +241,33 @@ func (handler *AuthHandler) HandleAuthRequest(protocol, user, pass string, attem
 	}
 
 	// query cache
+	route := selectRoute(handler.default_route, handler.routes, user)
+	cache_key := route.cacheKey(protocol, user)
 	password_bytes := []byte(pass)
-	decision, valid := handler.credentialsInCacheMatch(user, password_bytes)
+	result := handler.credentialsInCacheMatch(cache_key, user, password_bytes)
 
 	// cache content is invalid, so perform authentication
-	if !valid {
-		decision, valid = handler.imap_validator(handler.imap_host, handler.imap_port, user, pass, handler.ca_cert_file)
-		if decision && valid {
-			handler.addCredentialsToCache(user, password_bytes)
+	if !result.Valid {
+		request := ValidationRequest{Ctx: ctx, Protocol: protocol, User: user, Pass: pass, ClientIp: client_ip}
+		result = route.validator(request)
+		if result.Valid {
+			if err := handler.addCredentialsToCache(cache_key, user, password_bytes, result); err != nil {
+				log.Printf("caching credentials failed: %v", err)
+			}
+		} else if stale_result, removal_time := handler.staleCredentialsMatch(cache_key, password_bytes); stale_result.Valid {
+			log.Printf("backends of user %v unavailable, using expired cache entry", user)
+			handler.stale_hits.Add(1)
+			handler.revalidateInBackground(request, cache_key, route.validator, removal_time)
+			result = stale_result
 		}
 	}
 
-	if valid && decision {
-		return handler.createValidCredentialsResponse(protocol)
+	if result.Valid && result.Decision {
+		return handler.createValidCredentialsResponse(protocol, user, attempt, route, result)
+	} else if !result.Valid {
+		// the backends could not decide, e.g. because they are unreachable, so the
+		// client should not ask the user for another password
+		return createTemporaryFailureResponse(protocol, attempt)
 	} else {
 		return createInvalidCredentialsResponse(attempt)
 	}
@@ -104,106 +285,385 @@ func createInvalidCredentialsResponse(attempt int) AuthResponse {
 	return response
 }
 
-func (handler *AuthHandler) createValidCredentialsResponse(protocol string) AuthResponse {
+// createTemporaryFailureResponse tells the client to retry later, e.g. because
+// the upstream could not be determined or did not answer in time. IMAP clients
+// get the UNAVAILABLE response code of RFC 5530.
+func createTemporaryFailureResponse(protocol string, attempt int) AuthResponse {
+	response := AuthResponse{
+		Status:     "Temporary server problem, try again later",
+		Error_code: "454 4.7.0",
+		Wait:       attempt + 1,
+	}
+	if protocol == "imap" {
+		response.Status = "[UNAVAILABLE] " + response.Status
+	}
+	if attempt >= MAX_RETRIES {
+		response.Wait = -1
+	}
+	return response
+}
+
+func (handler *AuthHandler) createValidCredentialsResponse(protocol, user string, attempt int, route *authRoute, result ValidationResult) AuthResponse {
 	response := AuthResponse{
 		Status: "OK",
 	}
 
+	var host string
 	switch protocol {
 	case "imap":
-		response.Server = getIp(handler.imap_host)
-		response.Port = 993
+		// selecting another upstream would advance round robin a second time
+		if result.upstream != nil {
+			host, response.Port = result.upstream.host, result.upstream.port
+		} else {
+			host, response.Port = route.imapServer(user)
+		}
+		// the backend may route the user to another IMAP server, which does not
+		// apply to SMTP
+		if result.Server != "" {
+			host = result.Server
+		}
+		if result.Port != 0 {
+			response.Port = result.Port
+		}
+		response.User = result.User
+		response.Password = route.imap_login_password
+		// the login format applies to the username chosen by the backend
+		if route.imap_login_format != "" {
+			if response.User == "" {
+				response.User = user
+			}
+			response.User = route.formatImapLogin(response.User)
+		}
 	case "smtp":
-		response.Server = getIp(handler.smtp_host)
-		response.Port = 587
-		response.User = handler.smtp_user
-		response.Password = handler.smtp_password
+		host, response.Port = route.smtpServer(user)
+		response.User = route.smtp_user
+		response.Password = route.smtp_password
 	}
 
+	// nginx uses the login of the client unless told otherwise
+	if response.User == "" && handler.user_rewriter.return_canonical {
+		response.User = user
+	}
+
+	ip, err := handler.address_resolver.resolve(host, response.Port)
+	if err != nil {
+		log.Printf("resolving upstream of user %v failed: %v", user, err)
+		return createTemporaryFailureResponse(protocol, attempt)
+	}
+	response.Server = ip
+
 	return response
 }
 
-func getIp(hostname string) string {
-	ips, err := net.LookupIP(hostname)
-	if err != nil || len(ips) < 1 {
-		return hostname
+func (handler *AuthHandler) getCachePolicy(user string) cachePolicy {
+	if user_policy, found := handler.cache_user_policies[user]; found {
+		return user_policy
 	}
-	// prefer IPv4 addresses
-	for _, ip := range ips {
-		if ip.To4() != nil {
-			return ip.String()
+	return handler.cache_policy
+}
+
+// credentialsInCacheMatch looks up the authentication of the user stored under
+// key, see authRoute.cacheKey.
+func (handler *AuthHandler) credentialsInCacheMatch(key, user string, pass []byte) ValidationResult {
+	cache_policy := handler.getCachePolicy(user)
+	cache_entry, found_key := handler.auth_cache.get(key)
+
+	// key expired -> delete cache entry unless it may still be used during outages
+	if found_key && cache_entry.expiry.Before(time.Now()) {
+		if cache_entry.removalTime(handler.cache_stale_grace).Before(time.Now()) {
+			handler.auth_cache.delete(key)
+			handler.expired_evictions.Add(1)
 		}
+		found_key = false
 	}
-	return ips[0].String()
-}
 
-// return: bool (decision), bool (decision is valid)
-func (handler *AuthHandler) credentialsInCacheMatch(user string, pass []byte) (bool, bool) {
-	cache_entry, found_key := handler.auth_cache[user]
+	// hash has been created by another hasher -> ignore cache entry
+	var match bool
+	if found_key {
+		var err error
+		match, err = handler.password_hasher.compare(cache_entry.password_hash, pass)
+		found_key = err == nil
+	}
 
 	if found_key {
 
-		// key expired -> delete cache entry and exit
-		if cache_entry.expiry.Before(time.Now()) {
-			delete(handler.auth_cache, user)
-			return false, false
+		// credentials match credentials stored in cache
+		if match {
+			if cache_policy.sliding_expiry {
+				cache_entry.expiry = time.Now().Add(cache_policy.validity)
+				handler.auth_cache.put(key, cache_entry)
+			}
+			return ValidationResult{Decision: true, Valid: true, Server: cache_entry.server, Port: cache_entry.port, User: cache_entry.upstream_user}
 		}
 
-		// credentials match credentials stored in cache
-		if bcrypt.CompareHashAndPassword(cache_entry.password_hash, pass) == nil {
-			return true, true
+		// credentials do not match credentials stored in cache, but the password
+		// might have been changed
+		if !handler.cache_revalidate {
+			return ValidationResult{Decision: false, Valid: true}
 		}
+	}
 
-		// credentials do not match credentials stored in cache
-		return false, true
+	// credentials failed recently
+	if cache_policy.negative_validity > 0 {
+		negative_key := negativeCacheKey(handler.negative_secret, key, pass)
+		negative_entry, found_key := handler.auth_cache.get(negative_key)
+		if found_key && negative_entry.expiry.Before(time.Now()) {
+			handler.auth_cache.delete(negative_key)
+			handler.expired_evictions.Add(1)
+		} else if found_key {
+			return ValidationResult{Decision: false, Valid: true}
+		}
 	}
 
 	// no matching entry in cache
-	return false, false
+	return ValidationResult{Decision: false, Valid: false}
+}
+
+// staleCredentialsMatch accepts credentials matching a cache entry that expired
+// less than the stale grace period ago. It is only used if the backends cannot
+// decide.
+// return: the cached result and the time the sweeper removes the entry
+func (handler *AuthHandler) staleCredentialsMatch(key string, pass []byte) (ValidationResult, time.Time) {
+	cache_entry, found_key := handler.auth_cache.get(key)
+	if !found_key || cache_entry.negative {
+		return ValidationResult{Decision: false, Valid: false}, time.Time{}
+	}
+	removal_time := cache_entry.removalTime(handler.cache_stale_grace)
+	if removal_time.Before(time.Now()) {
+		return ValidationResult{Decision: false, Valid: false}, time.Time{}
+	}
+
+	match, err := handler.password_hasher.compare(cache_entry.password_hash, pass)
+	if err != nil || !match {
+		return ValidationResult{Decision: false, Valid: false}, time.Time{}
+	}
+	return ValidationResult{Decision: true, Valid: true, Server: cache_entry.server, Port: cache_entry.port, User: cache_entry.upstream_user}, removal_time
 }
 
-func (handler *AuthHandler) addCredentialsToCache(user string, pass []byte) error {
-	// add entry to cache
-	password_hash, err := bcrypt.GenerateFromPassword(pass, 10)
-	if err == nil {
+// revalidateInBackground refreshes the stale cache entry of the user once the
+// backends can decide again. If the backends reject the password, the entry is
+// removed. Retries stop once the stale entry is removed, so a late decision
+// cannot bring back an entry the sweeper dropped already.
+func (handler *AuthHandler) revalidateInBackground(request ValidationRequest, key string, validator CredentialsValidator, removal_time time.Time) {
+	if handler.cache_revalidator == nil {
+		return
+	}
+	password_bytes := []byte(request.Pass)
+	handler.cache_revalidator.schedule(request, validator, removal_time, func(result ValidationResult) {
+		handler.revalidations.Add(1)
+		if !result.Decision {
+			log.Printf("password of user %v changed during the outage", request.User)
+			handler.auth_cache.delete(key)
+		}
+		if err := handler.addCredentialsToCache(key, request.User, password_bytes, result); err != nil {
+			log.Printf("caching revalidated credentials failed: %v", err)
+		}
+	})
+}
+
+func (handler *AuthHandler) addCredentialsToCache(key, user string, pass []byte, result ValidationResult) error {
+	cache_policy := handler.getCachePolicy(user)
+
+	// only the key of failed credentials is relevant
+	if !result.Decision {
+		if cache_policy.negative_validity <= 0 {
+			return nil
+		}
 		cache_entry := authCacheEntry{
-			username:      user,
-			password_hash: password_hash,
-			expiry:        time.Now().Add(handler.cache_entry_validity),
+			username: user,
+			expiry:   time.Now().Add(cache_policy.negative_validity),
+			negative: true,
 		}
-		handler.auth_cache[user] = cache_entry
+		return handler.auth_cache.put(negativeCacheKey(handler.negative_secret, key, pass), cache_entry)
+	}
+
+	if cache_policy.validity <= 0 {
+		return nil
+	}
+	password_hash, err := handler.password_hasher.hash(pass)
+	if err != nil {
+		return err
+	}
+	cache_entry := authCacheEntry{
+		username:      user,
+		password_hash: password_hash,
+		expiry:        time.Now().Add(cache_policy.validity),
+		server:        result.Server,
+		port:          result.Port,
+		upstream_user: result.User,
 	}
-	return err
+	return handler.auth_cache.put(key, cache_entry)
+}
+
+// CacheEntryInfo describes a cached authentication without its password hash.
+type CacheEntryInfo struct {
+	User     string    `json:"user"`
+	Expiry   time.Time `json:"expiry"`
+	Negative bool      `json:"negative"`
+	Server   string    `json:"server,omitempty"`
+	Port     int       `json:"port,omitempty"`
 }
 
-// return: bool (decision), bool (decision is valid)
-func credentialsValidInImap(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-	// Load CA certificate file
-	caCert, err := os.ReadFile(ca_cert_file)
+// ListCache returns all cached authentications ordered by user and expiry.
+// Negative entries are failed authentications that are currently rejected
+// without asking the backends.
+func (handler *AuthHandler) ListCache() ([]CacheEntryInfo, error) {
+	entries, err := handler.auth_cache.list()
 	if err != nil {
-		return false, false
+		return nil, err
 	}
 
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return false, false
+	infos := make([]CacheEntryInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, CacheEntryInfo{
+			User:     entry.username,
+			Expiry:   entry.expiry,
+			Negative: entry.negative,
+			Server:   entry.server,
+			Port:     entry.port,
+		})
 	}
+	slices.SortFunc(infos, func(a, b CacheEntryInfo) int {
+		if a.User != b.User {
+			return strings.Compare(a.User, b.User)
+		}
+		return a.Expiry.Compare(b.Expiry)
+	})
+	return infos, nil
+}
 
-	tlsConfig := &tls.Config{
-		RootCAs: caCertPool,
+// FlushCache removes all cached authentications of the given user or all cached
+// authentications if the user is empty.
+// return: int (number of removed entries), error
+func (handler *AuthHandler) FlushCache(user string) (int, error) {
+	entries, err := handler.auth_cache.list()
+	if err != nil {
+		return 0, err
 	}
 
-	client, err := client.DialTLS(fmt.Sprintf("%s:%d", imap_host, imap_port), tlsConfig)
+	var keys []string
+	for key, entry := range entries {
+		if user == "" || entry.username == user {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := handler.auth_cache.deleteAll(keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func credentialsValidInImap(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+	address := net.JoinHostPort(imap_host, strconv.Itoa(imap_port))
+
+	imap_client, err := connectToImap(ctx, address, tls_settings)
 	if err != nil {
-		return false, false
+		log.Printf("connecting to %v failed: %v", address, err)
+		return ValidationResult{Decision: false, Valid: false, Timeout: isTimeout(ctx, err)}
 	}
-	defer client.Logout()
+	return loginToImap(ctx, imap_client, address, user, pass, tls_settings)
+}
 
-	if client.Login(user, pass) == nil {
-		return true, true
-	} else {
-		return false, true
+// loginToImap validates the credentials on a connected client and closes the
+// connection afterwards.
+func loginToImap(ctx context.Context, imap_client *client.Client, address, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+	stop := context.AfterFunc(ctx, func() {
+		imap_client.Terminate()
+	})
+	defer stop()
+
+	imap_client.Timeout = tls_settings.LoginTimeout
+	login_deadline := time.Now().Add(tls_settings.LoginTimeout)
+	err := imap_client.Login(user, pass)
+
+	// the client reports an exceeded deadline as closed connection
+	if err != nil && (isTimeout(ctx, err) || (tls_settings.LoginTimeout > 0 && !time.Now().Before(login_deadline))) {
+		log.Printf("login at %v timed out: %v", address, err)
+		imap_client.Terminate()
+		return ValidationResult{Decision: false, Valid: false, Timeout: true}
+	}
+	if err != nil && isConnectionLost(imap_client, err) {
+		log.Printf("connection to %v lost during login: %v", address, err)
+		return ValidationResult{Decision: false, Valid: false}
+	}
+	imap_client.Logout()
+	return ValidationResult{Decision: err == nil, Valid: true}
+}
+
+// connectToImap connects and secures the connection within the connect timeout.
+// The connection is closed if ctx is done before.
+func connectToImap(ctx context.Context, address string, tls_settings ImapTlsSettings) (*client.Client, error) {
+	if tls_settings.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tls_settings.ConnectTimeout)
+		defer cancel()
+	}
+
+	var conn net.Conn
+	var err error
+	switch tls_settings.Mode {
+	case IMAP_TLS_NONE:
+		conn, err = privateNetworkDialer().DialContext(ctx, "tcp", address)
+	case IMAP_TLS_STARTTLS:
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	default:
+		conn, err = (&tls.Dialer{Config: tls_settings.Config}).DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the greeting and STARTTLS are bound to the deadline of ctx, later commands
+	// to the timeout of the client
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// the client ignores failures of querying capabilities after the greeting
+	imap_client, err := client.New(conn)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && tls_settings.Mode == IMAP_TLS_STARTTLS {
+		if deadline, found := ctx.Deadline(); found {
+			imap_client.Timeout = max(time.Until(deadline), time.Millisecond)
+		}
+		// unlike the dialer, the client does not know the server name
+		tls_config := &tls.Config{}
+		if tls_settings.Config != nil {
+			tls_config = tls_settings.Config.Clone()
+		}
+		if tls_config.ServerName == "" {
+			tls_config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		err = imap_client.StartTLS(tls_config)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return imap_client, nil
+}
+
+func isTimeout(ctx context.Context, err error) bool {
+	var net_err net.Error
+	return ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &net_err) && net_err.Timeout())
+}
+
+// isConnectionLost tells if a command failed because the connection broke
+// instead of being answered by the server.
+func isConnectionLost(imap_client *client.Client, err error) bool {
+	select {
+	case <-imap_client.LoggedOut():
+		return true
+	default:
 	}
+	var op_err *net.OpError
+	return errors.Is(err, io.EOF) || errors.As(err, &op_err)
 }
 
 func contains(strings []string, search string) bool {
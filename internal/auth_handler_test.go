@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"context"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -8,67 +11,68 @@ import (
 )
 
 func TestNonWhitelistedCredentialsAuthHandler(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
 		t.Fatal("should not be called")
-		return false, false
+		return ValidationResult{Decision: false, Valid: false}
 	})
-	response := handler.HandleAuthRequest("imap", "test", "test", 3)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test", "test", "127.0.0.1", 3)
 	asserts.AssertEquals(t, "Invalid login or password", response.Status)
 	asserts.AssertEquals(t, "535 5.7.8", response.Error_code)
 	asserts.AssertEquals(t, -1, response.Wait)
 }
 
 func TestInvalidWhitelistedCredentialsAuthHandler(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return false, true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: false, Valid: true}
 	})
-	response := handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "Invalid login or password", response.Status)
 	asserts.AssertEquals(t, "535 5.7.8", response.Error_code)
 	asserts.AssertEquals(t, 2, response.Wait)
 }
 
 func TestInvalidCredentialsMaxTriesAuthHandler(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
 		t.Fatal("should not be called")
-		return false, false
+		return ValidationResult{Decision: false, Valid: false}
 	})
-	response := handler.HandleAuthRequest("imap", "test", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "Invalid login or password", response.Status)
 	asserts.AssertEquals(t, "535 5.7.8", response.Error_code)
 	asserts.AssertEquals(t, 2, response.Wait)
 }
 
 func TestValidCredentialsForIMAPAuthHandler(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return true, true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	response := handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	asserts.AssertEquals(t, "imap.example.org", response.Server)
+	asserts.AssertEquals(t, "192.0.2.10", response.Server)
 	asserts.AssertEquals(t, 993, response.Port)
 	asserts.AssertEquals(t, "", response.User)
 	asserts.AssertEquals(t, "", response.Password)
 }
 
 func TestValidCredentialsForSMTPAuthHandler(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return true, true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	response := handler.HandleAuthRequest("smtp", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	asserts.AssertEquals(t, "smtp.example.org", response.Server)
+	asserts.AssertEquals(t, "192.0.2.25", response.Server)
 	asserts.AssertEquals(t, 587, response.Port)
 	asserts.AssertEquals(t, "barfoo", response.User)
 	asserts.AssertEquals(t, "foobar", response.Password)
 }
 
 func TestValidCredentialsWithValidHostname(t *testing.T) {
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
-		return true, true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	handler.smtp_host = "a.root-servers.net"
-	response := handler.HandleAuthRequest("smtp", "test@example.org", "test", 1)
+	handler.default_route.smtp_host = "a.root-servers.net"
+	handler.address_resolver.resolver = net.DefaultResolver
+	response := handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
 	asserts.AssertEquals(t, "198.41.0.4", response.Server)
 	asserts.AssertEquals(t, 587, response.Port)
@@ -78,17 +82,17 @@ func TestValidCredentialsWithValidHostname(t *testing.T) {
 
 func TestValidCachedCredentialsAuthHandler(t *testing.T) {
 	validator_called := false
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
 		if validator_called {
 			t.Fatal("Validator should not be called twice.")
 		}
-		return true, true
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	response := handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	response = handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	asserts.AssertEquals(t, "imap.example.org", response.Server)
+	asserts.AssertEquals(t, "192.0.2.10", response.Server)
 	asserts.AssertEquals(t, 993, response.Port)
 	asserts.AssertEquals(t, "", response.User)
 	asserts.AssertEquals(t, "", response.Password)
@@ -96,20 +100,20 @@ func TestValidCachedCredentialsAuthHandler(t *testing.T) {
 
 func TestValidCachedButExpiredCredentialsAuthHandler(t *testing.T) {
 	validator_calls := 0
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
 		validator_calls++
-		return true, true
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	response := handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
 
 	// wait for cache entry to expire
 	time.Sleep(3 * time.Second)
 
 	// try again
-	response = handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	asserts.AssertEquals(t, "imap.example.org", response.Server)
+	asserts.AssertEquals(t, "192.0.2.10", response.Server)
 	asserts.AssertEquals(t, 993, response.Port)
 	asserts.AssertEquals(t, "", response.User)
 	asserts.AssertEquals(t, "", response.Password)
@@ -120,15 +124,15 @@ func TestValidCachedButExpiredCredentialsAuthHandler(t *testing.T) {
 
 func TestInvalidCachedCredentialsAuthHandler(t *testing.T) {
 	validator_called := false
-	handler := createAuthHandler(t, func(imap_host string, imap_port int, user, pass, ca_cert_file string) (bool, bool) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
 		if validator_called {
 			t.Fatal("Validator should not be called twice.")
 		}
-		return true, true
+		return ValidationResult{Decision: true, Valid: true}
 	})
-	response := handler.HandleAuthRequest("imap", "test@example.org", "test", 1)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "OK", response.Status)
-	response = handler.HandleAuthRequest("imap", "test@example.org", "test2", 1)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test2", "127.0.0.1", 1)
 	asserts.AssertEquals(t, "Invalid login or password", response.Status)
 	asserts.AssertEquals(t, "535 5.7.8", response.Error_code)
 	asserts.AssertEquals(t, 2, response.Wait)
@@ -140,7 +144,484 @@ func createAuthHandler(t *testing.T, validator ImapValidator) AuthHandler {
 	asserts.AssertNil(t, err)
 
 	cache_entry_validity, _ := time.ParseDuration("2s")
-	handler := CreateAuthHandlerWithCustomCallbacks(cfg, validator, cache_entry_validity)
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, validator, createFakeResolver(), cache_entry_validity)
+	asserts.AssertNil(t, err)
 	asserts.AssertNonNil(t, handler)
 	return handler
 }
+
+func TestValidCredentialsRoutedByBackend(t *testing.T) {
+	handler := createAuthHandler(t, nil)
+	handler.default_route.validator = func(request ValidationRequest) ValidationResult {
+		asserts.AssertEquals(t, "imap", request.Protocol)
+		return ValidationResult{Decision: true, Valid: true, Server: "imap2.example.org", Port: 1993}
+	}
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.11", response.Server)
+	asserts.AssertEquals(t, 1993, response.Port)
+
+	// routing is cached as well
+	handler.default_route.validator = func(request ValidationRequest) ValidationResult {
+		t.Fatal("should not be called")
+		return ValidationResult{}
+	}
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.11", response.Server)
+	asserts.AssertEquals(t, 1993, response.Port)
+
+	// the routing names an IMAP server, so SMTP still uses the SMTP upstream
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.25", response.Server)
+	asserts.AssertEquals(t, 587, response.Port)
+}
+
+func TestCachePerProtocolForProtocolAwareBackends(t *testing.T) {
+	handler := createAuthHandler(t, nil)
+	handler.default_route.cache_per_protocol = true
+	var validated []string
+	handler.default_route.validator = func(request ValidationRequest) ValidationResult {
+		validated = append(validated, request.Protocol)
+		return ValidationResult{Decision: request.Protocol == "imap", Valid: true}
+	}
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	// the IMAP login does not allow SMTP
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Invalid login or password", response.Status)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertStringArraysEquals(t, []string{"imap", "smtp"}, validated)
+
+	flushed, err := handler.FlushCache("test@example.org")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, flushed)
+}
+
+func TestDecidesByProtocol(t *testing.T) {
+	asserts.AssertEquals(t, false, decidesByProtocol([]BackendConfiguration{{Type: BACKEND_TYPE_IMAP}, {Type: BACKEND_TYPE_SQL}}))
+	asserts.AssertEquals(t, true, decidesByProtocol([]BackendConfiguration{{Type: BACKEND_TYPE_IMAP}, {Type: BACKEND_TYPE_WEBHOOK}}))
+	asserts.AssertEquals(t, true, decidesByProtocol([]BackendConfiguration{{Type: BACKEND_TYPE_DOVECOT}}))
+}
+
+func TestValidCredentialsWithRewrittenUser(t *testing.T) {
+	handler := createAuthHandler(t, nil)
+	handler.default_route.validator = func(request ValidationRequest) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true, User: "test*master"}
+	}
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "test*master", response.User)
+
+	// the SMTP upstream is always accessed with the configured user
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "barfoo", response.User)
+}
+
+func TestCanonicalUserAuthHandler(t *testing.T) {
+	var cfg Configuration
+	asserts.AssertNil(t, cfg.Load("testdata/config_users.yaml"))
+	var validated []string
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validated = append(validated, user)
+		return ValidationResult{Decision: pass == "test", Valid: true}
+	}, createFakeResolver(), 2*time.Second)
+	asserts.AssertNil(t, err)
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "Test+Lists", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "test@example.org", response.User)
+
+	// other spellings hit the same cache entry
+	response = handler.HandleAuthRequest(context.Background(), "imap", "TEST@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertStringArraysEquals(t, []string{"test@example.org"}, validated)
+
+	response = handler.HandleAuthRequest(context.Background(), "imap", "postmaster", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "admin@example.org", response.User)
+
+	// the whitelist is checked against the canonical name
+	response = handler.HandleAuthRequest(context.Background(), "imap", "other", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Invalid login or password", response.Status)
+	asserts.AssertStringArraysEquals(t, []string{"test@example.org", "admin@example.org"}, validated)
+}
+
+func TestCanonicalUserNotReturnedByDefault(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "", response.User)
+}
+
+func TestImapLoginFormatAuthHandler(t *testing.T) {
+	handler := createAuthHandler(t, nil)
+	handler.default_route.imap_login_format = "%n*master"
+	handler.default_route.imap_login_password = "masterpass"
+	handler.default_route.validator = func(request ValidationRequest) ValidationResult {
+		if request.User == "some_user" {
+			return ValidationResult{Decision: true, Valid: true, User: "other@example.org"}
+		}
+		return ValidationResult{Decision: true, Valid: true}
+	}
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "test*master", response.User)
+	asserts.AssertEquals(t, "masterpass", response.Password)
+
+	// the format applies to the username chosen by the backend
+	response = handler.HandleAuthRequest(context.Background(), "imap", "some_user", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "other*master", response.User)
+
+	// SMTP keeps using the configured user
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "barfoo", response.User)
+	asserts.AssertEquals(t, "foobar", response.Password)
+}
+
+func TestTimeoutAuthHandler(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false, Timeout: true}
+	})
+	response := handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Temporary server problem, try again later", response.Status)
+	asserts.AssertEquals(t, "454 4.7.0", response.Error_code)
+	asserts.AssertEquals(t, 2, response.Wait)
+}
+
+func TestUnreachableUpstreamAuthHandler(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false}
+	})
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 3)
+	asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+	asserts.AssertEquals(t, -1, response.Wait)
+
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Temporary server problem, try again later", response.Status)
+	asserts.AssertEquals(t, "454 4.7.0", response.Error_code)
+}
+
+func TestStaleCacheEntryUsedWhileUpstreamUnreachable(t *testing.T) {
+	reachable := true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: pass == "test", Valid: reachable}
+	})
+	handler.cache_stale_grace = time.Minute
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-time.Second))
+	reachable = false
+
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.10", response.Server)
+
+	// the stale entry does not reject other passwords
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+
+	// entries that expired before the grace period are removed
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-2*time.Minute))
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+	_, found := handler.auth_cache.get("test@example.org")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestStaleCacheEntryNotUsedByDefault(t *testing.T) {
+	reachable := true
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: reachable}
+	})
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-time.Second))
+	reachable = false
+
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+}
+
+func TestStaleCacheEntryRevalidatedInBackground(t *testing.T) {
+	var reachable atomic.Bool
+	var password atomic.Value
+	reachable.Store(true)
+	password.Store("test")
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: pass == password.Load(), Valid: reachable.Load()}
+	})
+	defer handler.Close()
+	handler.cache_stale_grace = time.Minute
+	handler.cache_revalidator = createCacheRevalidator(10 * time.Millisecond)
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-time.Second))
+	reachable.Store(false)
+
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, uint64(1), handler.stale_hits.Load())
+	asserts.AssertEquals(t, true, handler.cache_revalidator.isPending("test@example.org"))
+
+	// the upstream returns
+	reachable.Store(true)
+	waitForRevalidation(t, handler, "test@example.org")
+	entry, found := handler.auth_cache.get("test@example.org")
+	asserts.AssertEquals(t, true, found)
+	asserts.AssertEquals(t, true, entry.expiry.After(time.Now()))
+	asserts.AssertEquals(t, uint64(1), handler.revalidations.Load())
+
+	// the password changed during another outage
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-time.Second))
+	reachable.Store(false)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	password.Store("changed")
+	reachable.Store(true)
+	waitForRevalidation(t, handler, "test@example.org")
+	_, found = handler.auth_cache.get("test@example.org")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestStaleCacheEntryRevalidationEndsWithEntry(t *testing.T) {
+	var reachable atomic.Bool
+	reachable.Store(true)
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: reachable.Load()}
+	})
+	defer handler.Close()
+	handler.cache_stale_grace = time.Minute
+	handler.cache_revalidator = createCacheRevalidator(10 * time.Millisecond)
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	// the stale entry is removed in 100ms
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(100*time.Millisecond-time.Minute))
+	reachable.Store(false)
+
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, true, handler.cache_revalidator.isPending("test@example.org"))
+
+	// retries stop with the removal of the entry instead of a full grace period later
+	waitForRevalidation(t, handler, "test@example.org")
+	reachable.Store(true)
+	asserts.AssertEquals(t, uint64(0), handler.revalidations.Load())
+}
+
+func waitForRevalidation(t *testing.T, handler AuthHandler, user string) {
+	for start := time.Now(); handler.cache_revalidator.isPending(user); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("revalidation did not finish")
+		}
+	}
+}
+
+func expireCacheEntry(t *testing.T, handler AuthHandler, key string, expiry time.Time) {
+	entry, found := handler.auth_cache.get(key)
+	asserts.AssertEquals(t, true, found)
+	entry.expiry = expiry
+	asserts.AssertNil(t, handler.auth_cache.put(key, entry))
+}
+
+func TestRequestContextPassedToValidator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler := createAuthHandler(t, func(validator_ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		t.Fatal("should not be called")
+		return ValidationResult{}
+	})
+
+	// a canceled request does not query the upstreams anymore
+	response := handler.HandleAuthRequest(ctx, "smtp", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "454 4.7.0", response.Error_code)
+}
+
+func TestInvalidCredentialsNegativelyCached(t *testing.T) {
+	validator_calls := 0
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validator_calls++
+		return ValidationResult{Decision: pass == "test", Valid: true}
+	})
+	handler.cache_policy.negative_validity = time.Minute
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Invalid login or password", response.Status)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 2)
+	asserts.AssertEquals(t, "Invalid login or password", response.Status)
+	asserts.AssertEquals(t, 1, validator_calls)
+
+	// other passwords are still validated
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, 2, validator_calls)
+}
+
+func TestInvalidCredentialsNotCachedByDefault(t *testing.T) {
+	validator_calls := 0
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validator_calls++
+		return ValidationResult{Decision: false, Valid: true}
+	})
+
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 2)
+	asserts.AssertEquals(t, 2, validator_calls)
+}
+
+func TestValidCachedCredentialsWithSlidingExpiry(t *testing.T) {
+	validator_calls := 0
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validator_calls++
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	handler.cache_policy.sliding_expiry = true
+
+	// every use within the validity renews the entry
+	for i := 0; i < 3; i++ {
+		response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+		asserts.AssertEquals(t, "OK", response.Status)
+		time.Sleep(time.Second)
+	}
+	asserts.AssertEquals(t, 1, validator_calls)
+}
+
+func TestCachingDisabledForUser(t *testing.T) {
+	validator_calls := 0
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validator_calls++
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	handler.cache_user_policies["test@example.org"] = cachePolicy{validity: 0}
+
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, 2, validator_calls)
+}
+
+func TestMismatchingCachedCredentialsRevalidated(t *testing.T) {
+	password := "test"
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: pass == password, Valid: true}
+	})
+	handler.cache_revalidate = true
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+
+	// password changed at the upstream
+	password = "test2"
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test2", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "Invalid login or password", response.Status)
+}
+
+func TestFlushCache(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: pass == "test", Valid: true}
+	})
+	handler.cache_policy.negative_validity = time.Minute
+	handler.cache_revalidate = true
+
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "another_user", "test", "127.0.0.1", 1)
+
+	flushed, err := handler.FlushCache("test@example.org")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 2, flushed)
+
+	flushed, err = handler.FlushCache("")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, flushed)
+}
+
+func TestListCache(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: pass == "test", Valid: true}
+	})
+	handler.cache_policy.negative_validity = time.Minute
+	handler.cache_revalidate = true
+
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+	handler.HandleAuthRequest(context.Background(), "imap", "another_user", "test", "127.0.0.1", 1)
+
+	entries, err := handler.ListCache()
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 3, len(entries))
+	asserts.AssertEquals(t, "another_user", entries[0].User)
+	asserts.AssertEquals(t, "test@example.org", entries[1].User)
+	asserts.AssertEquals(t, false, entries[1].Negative)
+	asserts.AssertEquals(t, "test@example.org", entries[2].User)
+	asserts.AssertEquals(t, true, entries[2].Negative)
+}
+
+func TestCachedCredentialsOfOtherHasherIgnored(t *testing.T) {
+	validator_calls := 0
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validator_calls++
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+
+	// e.g. after changing the hash algorithm of a persistent cache
+	hmac_hasher, err := createHmacHasher()
+	asserts.AssertNil(t, err)
+	handler.password_hasher = hmac_hasher
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, 2, validator_calls)
+}
+
+func TestExpiredCacheEntriesCounted(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	defer handler.Close()
+	handler.cache_policy.validity = time.Millisecond
+
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	time.Sleep(10 * time.Millisecond)
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, uint64(1), handler.Metrics().Counter(`cache_evictions_total{reason="expired"}`, "").Load())
+}
+
+func TestCloseWaitsForAcquiredRequests(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true}
+	})
+	asserts.AssertEquals(t, true, handler.Acquire())
+
+	closed := make(chan struct{})
+	go func() {
+		handler.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	select {
+	case <-closed:
+		t.Fatal("closed while a request was running")
+	default:
+	}
+
+	handler.Release()
+	<-closed
+	asserts.AssertEquals(t, false, handler.Acquire())
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+const (
+	BACKEND_TYPE_IMAP    = "imap"
+	BACKEND_TYPE_SQL     = "sql"
+	BACKEND_TYPE_DOVECOT = "dovecot"
+	BACKEND_TYPE_RADIUS  = "radius"
+	BACKEND_TYPE_WEBHOOK = "webhook"
+
+	// accept the credentials as soon as one backend accepts them
+	POLICY_FIRST_SUCCESS = "first_success"
+	// accept the credentials only if all backends accept them
+	POLICY_ALL = "all"
+	// query the next backend only if the previous one could not decide (e.g. unreachable)
+	POLICY_FALLBACK = "fallback"
+)
+
+// ValidationRequest holds the data a backend needs to validate credentials.
+// Ctx is the context of the auth request, which is canceled if nginx gives up.
+type ValidationRequest struct {
+	Ctx      context.Context
+	Protocol string
+	User     string
+	Pass     string
+	ClientIp string
+}
+
+// Context returns the context of the request or the background context if the
+// request has none.
+func (request ValidationRequest) Context() context.Context {
+	if request.Ctx == nil {
+		return context.Background()
+	}
+	return request.Ctx
+}
+
+// ValidationResult follows the (decision, decision is valid) convention: Decision
+// tells if the credentials are accepted and Valid tells if a decision could be
+// made at all, e.g. Valid is false if the backend is unreachable. Server and
+// Port optionally route the user to another upstream than the configured one,
+// User optionally replaces the username used to login to the IMAP upstream.
+// Timeout tells if no decision could be made because the backend did not answer
+// in time. upstream is the IMAP upstream of a pool that decided, which nginx is
+// sent to as well. Unlike Server, it is not cached.
+type ValidationResult struct {
+	Decision bool
+	Valid    bool
+	Timeout  bool
+	Server   string
+	Port     int
+	User     string
+	upstream *imapUpstream
+}
+
+type CredentialsValidator func(request ValidationRequest) ValidationResult
+
+// closeFuncs collects the functions releasing the resources of backends, e.g.
+// database connections, which have to be called once the backends are not
+// used anymore.
+type closeFuncs []func() error
+
+func (funcs *closeFuncs) add(close func() error) {
+	*funcs = append(*funcs, close)
+}
+
+// closeAll calls all functions and logs their errors.
+func (funcs closeFuncs) closeAll() {
+	for _, close := range funcs {
+		if err := close(); err != nil {
+			log.Printf("closing backend failed: %v", err)
+		}
+	}
+}
+
+func createValidator(cfg Configuration, imap_validator ImapValidator, default_backend CredentialsValidator, closers *closeFuncs) (CredentialsValidator, error) {
+	// without explicit backends, validate against the IMAP upstreams used for IMAP
+	if len(cfg.Backends) == 0 {
+		return default_backend, nil
+	}
+
+	backends := make([]CredentialsValidator, 0, len(cfg.Backends))
+	for _, backend_cfg := range cfg.Backends {
+		backend, err := createBackend(backend_cfg, imap_validator, closers)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	return createChainedBackend(cfg.BackendPolicy, backends)
+}
+
+// decidesByProtocol tells if one of the backends is told the protocol of the
+// login and thus may decide differently for IMAP and SMTP.
+func decidesByProtocol(backends []BackendConfiguration) bool {
+	for _, backend := range backends {
+		if backend.Type == BACKEND_TYPE_WEBHOOK || backend.Type == BACKEND_TYPE_DOVECOT {
+			return true
+		}
+	}
+	return false
+}
+
+func createBackend(cfg BackendConfiguration, imap_validator ImapValidator, closers *closeFuncs) (CredentialsValidator, error) {
+	switch cfg.Type {
+	case BACKEND_TYPE_IMAP:
+		tls_settings, err := createImapTlsSettings(cfg.CaCertFile, cfg.ImapTlsConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		return createImapBackend(imap_validator, cfg.ImapServer, cfg.ImapPort, tls_settings), nil
+	case BACKEND_TYPE_SQL:
+		return createSqlBackend(cfg.SqlDriver, cfg.SqlDsn, cfg.SqlQuery, closers)
+	case BACKEND_TYPE_DOVECOT:
+		return createDovecotBackend(cfg.DovecotAddress), nil
+	case BACKEND_TYPE_RADIUS:
+		return createRadiusBackend(cfg.RadiusServers, cfg.RadiusSecret, cfg.RadiusTimeout), nil
+	case BACKEND_TYPE_WEBHOOK:
+		return createWebhookBackend(cfg.WebhookUrl, cfg.WebhookPasswordEncoding, cfg.CaCertFile, cfg.WebhookTimeout, closers)
+	}
+	return nil, fmt.Errorf("unsupported backend type %q", cfg.Type)
+}
+
+func createImapBackend(imap_validator ImapValidator, imap_host string, imap_port int, tls_settings ImapTlsSettings) CredentialsValidator {
+	return func(request ValidationRequest) ValidationResult {
+		return imap_validator(request.Context(), imap_host, imap_port, request.User, request.Pass, tls_settings)
+	}
+}
+
+func createChainedBackend(policy string, backends []CredentialsValidator) (CredentialsValidator, error) {
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+
+	switch policy {
+	case POLICY_FIRST_SUCCESS:
+		return func(request ValidationRequest) ValidationResult {
+			undecided := false
+			timeout := false
+			for _, backend := range backends {
+				result := backend(request)
+				if result.Valid && result.Decision {
+					return result
+				}
+				undecided = undecided || !result.Valid
+				timeout = timeout || result.Timeout
+			}
+			// a rejection is only definite if no backend was unreachable
+			return ValidationResult{Decision: false, Valid: !undecided, Timeout: undecided && timeout}
+		}, nil
+	case POLICY_ALL:
+		return func(request ValidationRequest) ValidationResult {
+			// the first backend routing the user or replacing the username wins
+			accepted := ValidationResult{Decision: true, Valid: true}
+			for _, backend := range backends {
+				result := backend(request)
+				if !result.Valid || !result.Decision {
+					return result
+				}
+				if accepted.Server == "" && accepted.upstream == nil {
+					accepted.Server, accepted.Port, accepted.upstream = result.Server, result.Port, result.upstream
+				}
+				if accepted.User == "" {
+					accepted.User = result.User
+				}
+			}
+			return accepted
+		}, nil
+	case POLICY_FALLBACK:
+		return func(request ValidationRequest) ValidationResult {
+			timeout := false
+			for _, backend := range backends {
+				result := backend(request)
+				if result.Valid {
+					return result
+				}
+				timeout = timeout || result.Timeout
+			}
+			return ValidationResult{Decision: false, Valid: false, Timeout: timeout}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported backend policy %q", policy)
+}
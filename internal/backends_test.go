@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestFirstSuccessPolicyAcceptsIfOneBackendAccepts(t *testing.T) {
+	result := validateWithChain(t, POLICY_FIRST_SUCCESS, rejectingBackend, acceptingBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestFirstSuccessPolicyRejectsIfAllBackendsReject(t *testing.T) {
+	result := validateWithChain(t, POLICY_FIRST_SUCCESS, rejectingBackend, rejectingBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestFirstSuccessPolicyUndecidedIfBackendUnreachable(t *testing.T) {
+	result := validateWithChain(t, POLICY_FIRST_SUCCESS, rejectingBackend, unreachableBackend)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestAllPolicyAcceptsIfAllBackendsAccept(t *testing.T) {
+	result := validateWithChain(t, POLICY_ALL, acceptingBackend, acceptingBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestAllPolicyKeepsRoutingOfBackends(t *testing.T) {
+	routing_backend := func(request ValidationRequest) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true, Server: "imap2.example.org", Port: 1993}
+	}
+	rewriting_backend := func(request ValidationRequest) ValidationResult {
+		return ValidationResult{Decision: true, Valid: true, Server: "imap3.example.org", Port: 2993, User: "test*master"}
+	}
+
+	result := validateWithChain(t, POLICY_ALL, acceptingBackend, routing_backend, rewriting_backend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertEquals(t, "imap2.example.org", result.Server)
+	asserts.AssertEquals(t, 1993, result.Port)
+	asserts.AssertEquals(t, "test*master", result.User)
+}
+
+func TestAllPolicyRejectsIfOneBackendRejects(t *testing.T) {
+	result := validateWithChain(t, POLICY_ALL, acceptingBackend, rejectingBackend, unreachableBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestAllPolicyUndecidedIfBackendUnreachable(t *testing.T) {
+	result := validateWithChain(t, POLICY_ALL, acceptingBackend, unreachableBackend)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestFallbackPolicyUsesSecondaryIfPrimaryUnreachable(t *testing.T) {
+	result := validateWithChain(t, POLICY_FALLBACK, unreachableBackend, acceptingBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestChainedBackendsReportTimeout(t *testing.T) {
+	result := validateWithChain(t, POLICY_FALLBACK, timedOutBackend, unreachableBackend)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+
+	result = validateWithChain(t, POLICY_FIRST_SUCCESS, timedOutBackend, rejectingBackend)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+
+	result = validateWithChain(t, POLICY_FALLBACK, timedOutBackend, acceptingBackend)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Timeout)
+}
+
+func TestFallbackPolicyDoesNotUseSecondaryIfPrimaryRejects(t *testing.T) {
+	result := validateWithChain(t, POLICY_FALLBACK, rejectingBackend, func(request ValidationRequest) ValidationResult {
+		t.Fatal("should not be called")
+		return ValidationResult{}
+	})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestUnsupportedBackendPolicy(t *testing.T) {
+	_, err := createChainedBackend("foo", []CredentialsValidator{acceptingBackend, acceptingBackend})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestUnsupportedBackendType(t *testing.T) {
+	_, err := createBackend(BackendConfiguration{Type: "foo"}, credentialsValidInImap, &closeFuncs{})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestImapBackendsFromConfiguration(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_backends.yaml")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "/custom/path/ca.crt", cfg.Backends[1].CaCertFile)
+	certPEM, _, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	cfg.Backends[1].CaCertFile = writeCaCertFile(t, certPEM)
+
+	var queried_hosts []string
+	validator, err := createValidator(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		queried_hosts = append(queried_hosts, imap_host)
+		if imap_host == "new-imap.example.org" {
+			asserts.AssertEquals(t, 1993, imap_port)
+			asserts.AssertNonNil(t, tls_settings.Config)
+			return ValidationResult{Decision: true, Valid: true}
+		}
+		return ValidationResult{Decision: false, Valid: false}
+	}, nil, &closeFuncs{})
+	asserts.AssertNil(t, err)
+
+	result := validator(ValidationRequest{User: "some_user", Pass: "test"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertStringArraysEquals(t, []string{"old-imap.example.org", "new-imap.example.org"}, queried_hosts)
+}
+
+func TestImapBackendWithMissingCaCertFile(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_backends.yaml")
+	asserts.AssertNil(t, err)
+
+	_, err = createValidator(cfg, credentialsValidInImap, nil, &closeFuncs{})
+	asserts.AssertNonNil(t, err)
+}
+
+func validateWithChain(t *testing.T, policy string, backends ...CredentialsValidator) ValidationResult {
+	chain, err := createChainedBackend(policy, backends)
+	asserts.AssertNil(t, err)
+	return chain(ValidationRequest{User: "test", Pass: "test"})
+}
+
+func acceptingBackend(request ValidationRequest) ValidationResult {
+	return ValidationResult{Decision: true, Valid: true}
+}
+
+func rejectingBackend(request ValidationRequest) ValidationResult {
+	return ValidationResult{Decision: false, Valid: true}
+}
+
+func unreachableBackend(request ValidationRequest) ValidationResult {
+	return ValidationResult{Decision: false, Valid: false}
+}
+
+func timedOutBackend(request ValidationRequest) ValidationResult {
+	return ValidationResult{Decision: false, Valid: false, Timeout: true}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	CACHE_HASH_BCRYPT   = "bcrypt"
+	CACHE_HASH_ARGON2ID = "argon2id"
+	// only usable with the memory cache store as the key is generated per process
+	CACHE_HASH_HMAC = "hmac"
+
+	HMAC_HASH_PREFIX = "$hmac-sha256$"
+)
+
+// passwordHasher hashes passwords of cached authentications. compare returns an
+// error if the hash has not been created by the hasher, e.g. after changing the
+// hash algorithm of a persistent cache.
+type passwordHasher interface {
+	hash(pass []byte) ([]byte, error)
+	compare(hash, pass []byte) (bool, error)
+}
+
+func createPasswordHasher(cfg Configuration) (passwordHasher, error) {
+	switch cfg.CacheHash {
+	case "", CACHE_HASH_BCRYPT:
+		cost := cfg.CacheHashCost
+		if cost == 0 {
+			cost = bcrypt.DefaultCost
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %v is out of range", cost)
+		}
+		return bcryptHasher{cost: cost}, nil
+	case CACHE_HASH_ARGON2ID:
+		if cfg.CacheHashTime == 0 || cfg.CacheHashMemory == 0 || cfg.CacheHashThreads == 0 {
+			return nil, fmt.Errorf("argon2id parameters must not be zero")
+		}
+		// cached hashes are verified like the hashes of the backends
+		if cfg.CacheHashMemory > ARGON2_MAX_MEMORY || cfg.CacheHashTime > ARGON2_MAX_TIME {
+			return nil, fmt.Errorf("argon2id parameters exceed %v KiB or %v iterations", ARGON2_MAX_MEMORY, ARGON2_MAX_TIME)
+		}
+		return argon2idHasher{time: cfg.CacheHashTime, memory: cfg.CacheHashMemory, threads: cfg.CacheHashThreads}, nil
+	case CACHE_HASH_HMAC:
+		if cfg.CacheStore != "" && cfg.CacheStore != CACHE_STORE_MEMORY {
+			return nil, fmt.Errorf("hmac hashes can only be used with the memory cache store")
+		}
+		return createHmacHasher()
+	}
+	return nil, fmt.Errorf("unsupported cache hash %q", cfg.CacheHash)
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (hasher bcryptHasher) hash(pass []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(pass, hasher.cost)
+}
+
+func (hasher bcryptHasher) compare(hash, pass []byte) (bool, error) {
+	if _, err := bcrypt.Cost(hash); err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword(hash, pass) == nil, nil
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (hasher argon2idHasher) hash(pass []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey(pass, salt, hasher.time, hasher.memory, hasher.threads, 32)
+	return fmt.Appendf(nil, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, hasher.memory, hasher.time, hasher.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (hasher argon2idHasher) compare(hash, pass []byte) (bool, error) {
+	if !strings.HasPrefix(string(hash), "$argon2id$") {
+		return false, fmt.Errorf("not an argon2id hash")
+	}
+	return verifyArgon2Hash(string(hash), pass)
+}
+
+type hmacHasher struct {
+	key []byte
+}
+
+func createHmacHasher() (hmacHasher, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return hmacHasher{key: key}, err
+}
+
+func (hasher hmacHasher) hash(pass []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, hasher.key)
+	mac.Write(pass)
+	return []byte(HMAC_HASH_PREFIX + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func (hasher hmacHasher) compare(hash, pass []byte) (bool, error) {
+	encoded, found := strings.CutPrefix(string(hash), HMAC_HASH_PREFIX)
+	if !found {
+		return false, fmt.Errorf("not an hmac hash")
+	}
+	expected, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false, err
+	}
+	mac := hmac.New(sha256.New, hasher.key)
+	mac.Write(pass)
+	return hmac.Equal(expected, mac.Sum(nil)), nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBcryptHasher(t *testing.T) {
+	hasher, err := createPasswordHasher(Configuration{CacheHash: CACHE_HASH_BCRYPT, CacheHashCost: bcrypt.MinCost})
+	asserts.AssertNil(t, err)
+	assertPasswordHasherWorks(t, hasher)
+}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher, err := createPasswordHasher(Configuration{CacheHash: CACHE_HASH_ARGON2ID, CacheHashTime: 1, CacheHashMemory: 1024, CacheHashThreads: 1})
+	asserts.AssertNil(t, err)
+	assertPasswordHasherWorks(t, hasher)
+}
+
+func TestHmacHasher(t *testing.T) {
+	hasher, err := createPasswordHasher(Configuration{CacheHash: CACHE_HASH_HMAC})
+	asserts.AssertNil(t, err)
+	assertPasswordHasherWorks(t, hasher)
+
+	// keys differ per process (here: per hasher)
+	other_hasher, err := createPasswordHasher(Configuration{CacheHash: CACHE_HASH_HMAC})
+	asserts.AssertNil(t, err)
+	hash, err := hasher.hash([]byte("secret"))
+	asserts.AssertNil(t, err)
+	match, err := other_hasher.compare(hash, []byte("secret"))
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, false, match)
+}
+
+func TestHmacHasherRequiresMemoryStore(t *testing.T) {
+	_, err := createPasswordHasher(Configuration{CacheHash: CACHE_HASH_HMAC, CacheStore: CACHE_STORE_FILE})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestInvalidHasherConfiguration(t *testing.T) {
+	_, err := createPasswordHasher(Configuration{CacheHash: "foo"})
+	asserts.AssertNonNil(t, err)
+	_, err = createPasswordHasher(Configuration{CacheHash: CACHE_HASH_BCRYPT, CacheHashCost: 100})
+	asserts.AssertNonNil(t, err)
+	_, err = createPasswordHasher(Configuration{CacheHash: CACHE_HASH_ARGON2ID})
+	asserts.AssertNonNil(t, err)
+	_, err = createPasswordHasher(Configuration{CacheHash: CACHE_HASH_ARGON2ID, CacheHashTime: 1, CacheHashMemory: 1024 * 1024, CacheHashThreads: 1})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestHashOfOtherHasherNotComparable(t *testing.T) {
+	bcrypt_hasher := bcryptHasher{cost: bcrypt.MinCost}
+	argon2id_hasher := argon2idHasher{time: 1, memory: 1024, threads: 1}
+	hmac_hasher, err := createHmacHasher()
+	asserts.AssertNil(t, err)
+
+	hash, err := bcrypt_hasher.hash([]byte("secret"))
+	asserts.AssertNil(t, err)
+	_, err = argon2id_hasher.compare(hash, []byte("secret"))
+	asserts.AssertNonNil(t, err)
+	_, err = hmac_hasher.compare(hash, []byte("secret"))
+	asserts.AssertNonNil(t, err)
+
+	hash, err = argon2id_hasher.hash([]byte("secret"))
+	asserts.AssertNil(t, err)
+	_, err = bcrypt_hasher.compare(hash, []byte("secret"))
+	asserts.AssertNonNil(t, err)
+}
+
+func BenchmarkBcryptHasher(b *testing.B) {
+	benchmarkPasswordHasher(b, bcryptHasher{cost: 10})
+}
+
+func BenchmarkBcryptHasherLowCost(b *testing.B) {
+	benchmarkPasswordHasher(b, bcryptHasher{cost: bcrypt.MinCost})
+}
+
+func BenchmarkArgon2idHasher(b *testing.B) {
+	benchmarkPasswordHasher(b, argon2idHasher{time: 2, memory: 19 * 1024, threads: 1})
+}
+
+func BenchmarkHmacHasher(b *testing.B) {
+	hasher, err := createHmacHasher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPasswordHasher(b, hasher)
+}
+
+// benchmarkPasswordHasher measures hashing and comparing, i.e. the costs of an
+// uncached login and a cached login
+func benchmarkPasswordHasher(b *testing.B, hasher passwordHasher) {
+	for b.Loop() {
+		hash, err := hasher.hash([]byte("secret"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if match, err := hasher.compare(hash, []byte("secret")); err != nil || !match {
+			b.Fatal("hash does not match")
+		}
+	}
+}
+
+func assertPasswordHasherWorks(t *testing.T, hasher passwordHasher) {
+	hash, err := hasher.hash([]byte("secret"))
+	asserts.AssertNil(t, err)
+
+	match, err := hasher.compare(hash, []byte("secret"))
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, true, match)
+
+	match, err = hasher.compare(hash, []byte("wrong"))
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, false, match)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cacheRevalidator validates the credentials of stale cache entries in the
+// background until the backends can decide again, so that the entries are
+// refreshed as soon as the upstream returns. The password has to be kept in
+// memory until then. Only one revalidation per user is pending at a time.
+type cacheRevalidator struct {
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	pending  map[string]struct{}
+	running  sync.WaitGroup
+}
+
+func createCacheRevalidator(interval time.Duration) *cacheRevalidator {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cacheRevalidator{
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// schedule retries the request every interval until the validator decides or
+// the deadline passes. The decision is passed to done.
+func (revalidator *cacheRevalidator) schedule(request ValidationRequest, validator CredentialsValidator, deadline time.Time, done func(ValidationResult)) {
+	revalidator.mutex.Lock()
+	defer revalidator.mutex.Unlock()
+	if _, found := revalidator.pending[request.User]; found || revalidator.ctx.Err() != nil {
+		return
+	}
+	revalidator.pending[request.User] = struct{}{}
+	revalidator.running.Add(1)
+
+	// the request of nginx is answered already
+	request.Ctx = revalidator.ctx
+
+	go func() {
+		defer revalidator.running.Done()
+		defer func() {
+			revalidator.mutex.Lock()
+			delete(revalidator.pending, request.User)
+			revalidator.mutex.Unlock()
+		}()
+
+		ticker := time.NewTicker(revalidator.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-revalidator.ctx.Done():
+				return
+			case now := <-ticker.C:
+				if now.After(deadline) {
+					return
+				}
+				if result := validator(request); result.Valid {
+					done(result)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// isPending tells if a revalidation of the user is scheduled.
+func (revalidator *cacheRevalidator) isPending(user string) bool {
+	revalidator.mutex.Lock()
+	defer revalidator.mutex.Unlock()
+	_, found := revalidator.pending[user]
+	return found
+}
+
+// Stop cancels all pending revalidations and waits until they finished.
+func (revalidator *cacheRevalidator) Stop() {
+	revalidator.mutex.Lock()
+	revalidator.cancel()
+	revalidator.mutex.Unlock()
+	revalidator.running.Wait()
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestCacheRevalidatorRetriesUntilDecided(t *testing.T) {
+	revalidator := createCacheRevalidator(10 * time.Millisecond)
+	defer revalidator.Stop()
+
+	var calls atomic.Int32
+	decided := make(chan ValidationResult, 1)
+	revalidator.schedule(ValidationRequest{User: "test", Pass: "test"}, func(request ValidationRequest) ValidationResult {
+		asserts.AssertNonNil(t, request.Ctx)
+		return ValidationResult{Decision: true, Valid: calls.Add(1) >= 3}
+	}, time.Now().Add(time.Minute), func(result ValidationResult) {
+		decided <- result
+	})
+
+	select {
+	case result := <-decided:
+		asserts.AssertEquals(t, true, result.Decision)
+		asserts.AssertEquals(t, int32(3), calls.Load())
+	case <-time.After(5 * time.Second):
+		t.Fatal("revalidation did not finish")
+	}
+	revalidator.Stop()
+	asserts.AssertEquals(t, false, revalidator.isPending("test"))
+}
+
+func TestCacheRevalidatorSchedulesOncePerUser(t *testing.T) {
+	revalidator := createCacheRevalidator(time.Hour)
+	defer revalidator.Stop()
+
+	unreachable := func(request ValidationRequest) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false}
+	}
+	revalidator.schedule(ValidationRequest{User: "test"}, unreachable, time.Now().Add(time.Minute), func(ValidationResult) {})
+	revalidator.schedule(ValidationRequest{User: "test"}, unreachable, time.Now().Add(time.Minute), func(ValidationResult) {})
+	revalidator.schedule(ValidationRequest{User: "other"}, unreachable, time.Now().Add(time.Minute), func(ValidationResult) {})
+
+	asserts.AssertEquals(t, true, revalidator.isPending("test"))
+	asserts.AssertEquals(t, 2, len(revalidator.pending))
+}
+
+func TestCacheRevalidatorGivesUpAfterDeadline(t *testing.T) {
+	revalidator := createCacheRevalidator(10 * time.Millisecond)
+	defer revalidator.Stop()
+
+	revalidator.schedule(ValidationRequest{User: "test"}, func(request ValidationRequest) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false}
+	}, time.Now().Add(50*time.Millisecond), func(ValidationResult) {
+		t.Error("should not be called")
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	asserts.AssertEquals(t, false, revalidator.isPending("test"))
+}
+
+func TestCacheRevalidatorStopCancelsPendingRevalidations(t *testing.T) {
+	revalidator := createCacheRevalidator(time.Hour)
+	revalidator.schedule(ValidationRequest{User: "test"}, func(request ValidationRequest) ValidationResult {
+		t.Error("should not be called")
+		return ValidationResult{}
+	}, time.Now().Add(time.Minute), func(ValidationResult) {})
+
+	revalidator.Stop()
+	asserts.AssertEquals(t, false, revalidator.isPending("test"))
+
+	// nothing is scheduled after stopping
+	revalidator.schedule(ValidationRequest{User: "test"}, nil, time.Now().Add(time.Minute), nil)
+	asserts.AssertEquals(t, false, revalidator.isPending("test"))
+}
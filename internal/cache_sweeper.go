@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// cacheSweeper periodically removes expired entries, so that entries of users
+// that never login again do not stay in the cache forever.
+type cacheSweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startCacheSweeper(cache authCache, interval, stale_grace time.Duration, evictions *atomic.Uint64) *cacheSweeper {
+	sweeper := &cacheSweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sweeper.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sweeper.stop:
+				return
+			case now := <-ticker.C:
+				swept, err := sweepAuthCache(cache, now, stale_grace)
+				if err != nil {
+					log.Printf("sweeping cache failed: %v", err)
+				}
+				evictions.Add(uint64(swept))
+			}
+		}
+	}()
+
+	return sweeper
+}
+
+// Stop stops the sweeper and waits until it finished.
+func (sweeper *cacheSweeper) Stop() {
+	close(sweeper.stop)
+	<-sweeper.done
+}
+
+// return: int (number of removed entries), error
+func sweepAuthCache(cache authCache, now time.Time, stale_grace time.Duration) (int, error) {
+	entries, err := cache.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var expired_keys []string
+	for key, entry := range entries {
+		if entry.removalTime(stale_grace).Before(now) {
+			expired_keys = append(expired_keys, key)
+		}
+	}
+	if len(expired_keys) == 0 {
+		return 0, nil
+	}
+	if err := cache.deleteAll(expired_keys); err != nil {
+		return 0, err
+	}
+	return len(expired_keys), nil
+}
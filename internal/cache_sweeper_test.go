@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestSweepAuthCache(t *testing.T) {
+	cache := createMemoryAuthCache(0, &atomic.Uint64{})
+	now := time.Now()
+	asserts.AssertNil(t, cache.put("expired", authCacheEntry{username: "expired", expiry: now.Add(-time.Second)}))
+	asserts.AssertNil(t, cache.put("valid", authCacheEntry{username: "valid", expiry: now.Add(time.Second)}))
+
+	swept, err := sweepAuthCache(cache, now, 0)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, swept)
+	_, found := cache.get("expired")
+	asserts.AssertEquals(t, false, found)
+	_, found = cache.get("valid")
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestSweepAuthCacheKeepsStaleEntries(t *testing.T) {
+	cache := createMemoryAuthCache(0, &atomic.Uint64{})
+	now := time.Now()
+	asserts.AssertNil(t, cache.put("stale", authCacheEntry{username: "stale", expiry: now.Add(-time.Second)}))
+	asserts.AssertNil(t, cache.put("too_old", authCacheEntry{username: "too_old", expiry: now.Add(-2 * time.Minute)}))
+	asserts.AssertNil(t, cache.put("negative", authCacheEntry{username: "negative", expiry: now.Add(-time.Second), negative: true}))
+
+	swept, err := sweepAuthCache(cache, now, time.Minute)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 2, swept)
+	_, found := cache.get("stale")
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestCacheSweeperRunsPeriodically(t *testing.T) {
+	cache := createMemoryAuthCache(0, &atomic.Uint64{})
+	asserts.AssertNil(t, cache.put("expired", authCacheEntry{username: "expired", expiry: time.Now().Add(-time.Second)}))
+
+	evictions := &atomic.Uint64{}
+	sweeper := startCacheSweeper(cache, 10*time.Millisecond, 0, evictions)
+	time.Sleep(100 * time.Millisecond)
+	sweeper.Stop()
+
+	_, found := cache.get("expired")
+	asserts.AssertEquals(t, false, found)
+	asserts.AssertEquals(t, uint64(1), evictions.Load())
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// validations are passed to the upstream
+	CIRCUIT_CLOSED = 0
+	// validations fail without contacting the upstream
+	CIRCUIT_OPEN = 1
+	// a single validation probes if the upstream is back
+	CIRCUIT_HALF_OPEN = 2
+)
+
+// circuitBreaker stops validating at an upstream after threshold consecutive
+// validations could not decide. After open_duration, a single probe is let
+// through, which closes the circuit if the upstream decides and opens it again
+// otherwise.
+type circuitBreaker struct {
+	threshold     int
+	open_duration time.Duration
+	mutex         sync.Mutex
+	state         int
+	failures      int
+	opened        time.Time
+	probing       bool
+}
+
+// allow tells if a validation may be passed to the upstream. In the half-open
+// state, only the first caller becomes the probe.
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == CIRCUIT_OPEN && time.Since(breaker.opened) >= breaker.open_duration {
+		breaker.state = CIRCUIT_HALF_OPEN
+		breaker.probing = false
+	}
+	switch breaker.state {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_HALF_OPEN:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+		return true
+	}
+	return false
+}
+
+// record updates the state by the outcome of an allowed validation. decided
+// tells if the upstream could decide, regardless of the decision.
+// return: true if the circuit has been opened
+func (breaker *circuitBreaker) record(decided bool) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probing = false
+	if decided {
+		breaker.state = CIRCUIT_CLOSED
+		breaker.failures = 0
+		return false
+	}
+	breaker.failures++
+	if breaker.state != CIRCUIT_OPEN && (breaker.state == CIRCUIT_HALF_OPEN || breaker.failures >= breaker.threshold) {
+		breaker.state = CIRCUIT_OPEN
+		breaker.opened = time.Now()
+		return true
+	}
+	return false
+}
+
+// currentState reports an open circuit as half-open once a probe would be let
+// through.
+func (breaker *circuitBreaker) currentState() int {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == CIRCUIT_OPEN && time.Since(breaker.opened) >= breaker.open_duration {
+		return CIRCUIT_HALF_OPEN
+	}
+	return breaker.state
+}
+
+// circuitBreakers holds a circuit breaker per IMAP upstream. Breakers are
+// created on the first validation at an upstream, so that discovered upstreams
+// are covered as well.
+type circuitBreakers struct {
+	threshold     int
+	open_duration time.Duration
+	metrics       *Metrics
+	rejections    *atomic.Uint64
+	mutex         sync.Mutex
+	breakers      map[string]*circuitBreaker
+}
+
+func createCircuitBreakers(threshold int, open_duration time.Duration, metrics *Metrics) *circuitBreakers {
+	return &circuitBreakers{
+		threshold:     threshold,
+		open_duration: open_duration,
+		metrics:       metrics,
+		rejections:    metrics.Counter("imap_circuit_breaker_rejections_total", "Number of validations failed fast because the circuit of the IMAP upstream was open."),
+		breakers:      make(map[string]*circuitBreaker),
+	}
+}
+
+// get returns the breaker of the address and creates it if required.
+func (breakers *circuitBreakers) get(address string) *circuitBreaker {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breaker, found := breakers.breakers[address]
+	if !found {
+		breaker = &circuitBreaker{threshold: breakers.threshold, open_duration: breakers.open_duration}
+		breakers.breakers[address] = breaker
+		breakers.metrics.Gauge(fmt.Sprintf(`imap_circuit_breaker_state{upstream=%q}`, address), "State of the circuit breaker of the IMAP upstream (0 closed, 1 open, 2 half-open).", func() float64 {
+			return float64(breaker.currentState())
+		})
+	}
+	return breaker
+}
+
+// wrap returns an ImapValidator that fails fast while the circuit of the
+// upstream is open. Failing fast is reported as undecided, so that expired
+// cache entries may still be used.
+func (breakers *circuitBreakers) wrap(imap_validator ImapValidator) ImapValidator {
+	return func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		address := net.JoinHostPort(imap_host, strconv.Itoa(imap_port))
+		breaker := breakers.get(address)
+		if !breaker.allow() {
+			breakers.rejections.Add(1)
+			return ValidationResult{Decision: false, Valid: false}
+		}
+
+		// nginx giving up counts as failure, as it usually means that the
+		// upstream did not answer in time
+		result := imap_validator(ctx, imap_host, imap_port, user, pass, tls_settings)
+		if breaker.record(result.Valid) {
+			log.Printf("IMAP upstream %v could not decide repeatedly, failing fast for %v", address, breakers.open_duration)
+		}
+		return result
+	}
+}
+
+// openUpstreams returns the addresses of the upstreams whose circuit is open.
+func (breakers *circuitBreakers) openUpstreams() []string {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	var open []string
+	for _, address := range slices.Sorted(maps.Keys(breakers.breakers)) {
+		if breakers.breakers[address].currentState() == CIRCUIT_OPEN {
+			open = append(open, address)
+		}
+	}
+	return open
+}
+
+// allOpen tells if the circuits of all known upstreams are open, i.e. no
+// validation can currently reach an upstream.
+func (breakers *circuitBreakers) allOpen() bool {
+	breakers.mutex.Lock()
+	count := len(breakers.breakers)
+	breakers.mutex.Unlock()
+	return count > 0 && len(breakers.openUpstreams()) == count
+}
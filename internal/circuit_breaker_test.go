@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 3, open_duration: time.Minute}
+
+	for range 2 {
+		asserts.AssertEquals(t, true, breaker.allow())
+		asserts.AssertEquals(t, false, breaker.record(false))
+	}
+	// a decision resets the failures
+	asserts.AssertEquals(t, true, breaker.allow())
+	breaker.record(true)
+	for range 2 {
+		asserts.AssertEquals(t, true, breaker.allow())
+		asserts.AssertEquals(t, false, breaker.record(false))
+	}
+	asserts.AssertEquals(t, CIRCUIT_CLOSED, breaker.currentState())
+
+	asserts.AssertEquals(t, true, breaker.allow())
+	asserts.AssertEquals(t, true, breaker.record(false))
+	asserts.AssertEquals(t, CIRCUIT_OPEN, breaker.currentState())
+	asserts.AssertEquals(t, false, breaker.allow())
+}
+
+func TestCircuitBreakerProbesWhenHalfOpen(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, open_duration: 20 * time.Millisecond}
+	breaker.allow()
+	breaker.record(false)
+	asserts.AssertEquals(t, false, breaker.allow())
+
+	time.Sleep(30 * time.Millisecond)
+	asserts.AssertEquals(t, CIRCUIT_HALF_OPEN, breaker.currentState())
+	// only a single probe is let through
+	asserts.AssertEquals(t, true, breaker.allow())
+	asserts.AssertEquals(t, false, breaker.allow())
+
+	// a failed probe opens the circuit again
+	asserts.AssertEquals(t, true, breaker.record(false))
+	asserts.AssertEquals(t, CIRCUIT_OPEN, breaker.currentState())
+
+	time.Sleep(30 * time.Millisecond)
+	asserts.AssertEquals(t, true, breaker.allow())
+	breaker.record(true)
+	asserts.AssertEquals(t, CIRCUIT_CLOSED, breaker.currentState())
+	asserts.AssertEquals(t, true, breaker.allow())
+	asserts.AssertEquals(t, true, breaker.allow())
+}
+
+func TestCircuitBreakersFailFastPerUpstream(t *testing.T) {
+	metrics := CreateMetrics()
+	breakers := createCircuitBreakers(2, time.Minute, metrics)
+	var calls atomic.Int32
+	validator := breakers.wrap(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		calls.Add(1)
+		return ValidationResult{Decision: false, Valid: imap_host == "reachable.example.org"}
+	})
+
+	for range 3 {
+		result := validator(context.Background(), "unreachable.example.org", 993, "test", "test", ImapTlsSettings{})
+		asserts.AssertEquals(t, false, result.Valid)
+	}
+	asserts.AssertEquals(t, int32(2), calls.Load())
+	asserts.AssertEquals(t, uint64(1), breakers.rejections.Load())
+
+	result := validator(context.Background(), "reachable.example.org", 993, "test", "test", ImapTlsSettings{})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, int32(3), calls.Load())
+
+	asserts.AssertStringArraysEquals(t, []string{"unreachable.example.org:993"}, breakers.openUpstreams())
+	asserts.AssertEquals(t, false, breakers.allOpen())
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	asserts.AssertEquals(t, true, strings.Contains(w.Body.String(), `nginxmailauthdelegator_imap_circuit_breaker_state{upstream="unreachable.example.org:993"} 1`))
+	asserts.AssertEquals(t, true, strings.Contains(w.Body.String(), `nginxmailauthdelegator_imap_circuit_breaker_state{upstream="reachable.example.org:993"} 0`))
+}
+
+func TestCircuitBreakerAuthHandler(t *testing.T) {
+	var cfg Configuration
+	asserts.AssertNil(t, cfg.Load("testdata/config.yaml"))
+	cfg.CircuitBreakerThreshold = 2
+
+	var reachable atomic.Bool
+	var calls atomic.Int32
+	reachable.Store(true)
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		calls.Add(1)
+		return ValidationResult{Decision: pass == "test", Valid: reachable.Load()}
+	}, createFakeResolver(), 2*time.Second)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+	handler.cache_stale_grace = time.Minute
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	ready, _ := handler.Ready()
+	asserts.AssertEquals(t, true, ready)
+
+	expireCacheEntry(t, handler, "test@example.org", time.Now().Add(-time.Second))
+	reachable.Store(false)
+	for range 2 {
+		response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "wrong", "127.0.0.1", 1)
+		asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+	}
+	asserts.AssertEquals(t, int32(3), calls.Load())
+	ready, open_upstreams := handler.Ready()
+	asserts.AssertEquals(t, false, ready)
+	asserts.AssertEquals(t, 1, len(open_upstreams))
+
+	// fails fast and falls back to the expired cache entry
+	response = handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, int32(3), calls.Load())
+}
+
+func TestReadyWithoutCircuitBreakers(t *testing.T) {
+	handler := createAuthHandler(t, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false}
+	})
+	handler.HandleAuthRequest(context.Background(), "imap", "test@example.org", "test", "127.0.0.1", 1)
+
+	ready, open_upstreams := handler.Ready()
+	asserts.AssertEquals(t, true, ready)
+	asserts.AssertEquals(t, 0, len(open_upstreams))
+}
@@ -2,18 +2,135 @@ package internal
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Configuration struct {
-	WhitelistedUsers []string `yaml:"users"`
-	ImapServer       string   `yaml:"imap_host"`
-	ImapPort         int      `yaml:"imap_port"`
-	SmtpServer       string   `yaml:"smtp_host"`
-	SmtpUser         string   `yaml:"smtp_user"`
-	SmtpPass         string   `yaml:"smtp_pass"`
-	CaCertFile       string   `yaml:"ca_cert_file"`
+	WhitelistedUsers             []string                              `yaml:"users"`
+	UserLowercase                bool                                  `yaml:"user_lowercase"`
+	UserDefaultDomain            string                                `yaml:"user_default_domain"`
+	UserSubstitutions            []UserSubstitutionConfiguration       `yaml:"user_substitutions"`
+	UserAliases                  map[string]string                     `yaml:"user_aliases"`
+	UserReturnCanonical          bool                                  `yaml:"user_return_canonical"`
+	ImapServer                   string                                `yaml:"imap_host"`
+	ImapPort                     int                                   `yaml:"imap_port"`
+	SmtpServer                   string                                `yaml:"smtp_host"`
+	SmtpPort                     int                                   `yaml:"smtp_port"`
+	SmtpUser                     string                                `yaml:"smtp_user"`
+	SmtpPass                     string                                `yaml:"smtp_pass"`
+	ImapLoginFormat              string                                `yaml:"imap_login_format"`
+	ImapLoginPassword            string                                `yaml:"imap_login_password"`
+	CaCertFile                   string                                `yaml:"ca_cert_file"`
+	ImapUpstreams                []ImapUpstreamConfiguration           `yaml:"imap_upstreams"`
+	ImapUpstreamStrategy         string                                `yaml:"imap_upstream_strategy"`
+	ImapHealthCheckInterval      time.Duration                         `yaml:"imap_health_check_interval"`
+	ImapPoolSize                 int                                   `yaml:"imap_pool_size"`
+	ImapPoolMaxIdle              time.Duration                         `yaml:"imap_pool_max_idle"`
+	CircuitBreakerThreshold      int                                   `yaml:"circuit_breaker_threshold"`
+	CircuitBreakerOpenDuration   time.Duration                         `yaml:"circuit_breaker_open_duration"`
+	BackendPolicy                string                                `yaml:"backend_policy"`
+	Backends                     []BackendConfiguration                `yaml:"backends"`
+	Routes                       []RouteConfiguration                  `yaml:"routes"`
+	UpstreamDiscovery            bool                                  `yaml:"upstream_discovery"`
+	DnsCacheTtl                  time.Duration                         `yaml:"dns_cache_ttl"`
+	IpPreference                 string                                `yaml:"ip_preference"`
+	CacheStore                   string                                `yaml:"cache_store"`
+	CacheFile                    string                                `yaml:"cache_file"`
+	CacheRedisAddress            string                                `yaml:"cache_redis_address"`
+	CacheRedisPassword           string                                `yaml:"cache_redis_password"`
+	CacheRedisDb                 int                                   `yaml:"cache_redis_db"`
+	CacheRedisKeyPrefix          string                                `yaml:"cache_redis_key_prefix"`
+	CacheTtl                     *time.Duration                        `yaml:"cache_ttl"`
+	CacheNegativeTtl             time.Duration                         `yaml:"cache_negative_ttl"`
+	CacheNegativeSecret          string                                `yaml:"cache_negative_secret"`
+	CacheExpiry                  string                                `yaml:"cache_expiry"`
+	CacheMismatch                string                                `yaml:"cache_mismatch"`
+	CacheMaxEntries              int                                   `yaml:"cache_max_entries"`
+	CacheSweepInterval           *time.Duration                        `yaml:"cache_sweep_interval"`
+	CacheStaleGrace              time.Duration                         `yaml:"cache_stale_grace"`
+	CacheStaleRevalidateInterval time.Duration                         `yaml:"cache_stale_revalidate_interval"`
+	CacheHash                    string                                `yaml:"cache_hash"`
+	CacheHashCost                int                                   `yaml:"cache_hash_cost"`
+	CacheHashTime                uint32                                `yaml:"cache_hash_time"`
+	CacheHashMemory              uint32                                `yaml:"cache_hash_memory"`
+	CacheHashThreads             uint8                                 `yaml:"cache_hash_threads"`
+	CacheUserOverrides           map[string]CacheOverrideConfiguration `yaml:"cache_user_overrides"`
+	AdminAddress                 string                                `yaml:"admin_address"`
+	AdminToken                   string                                `yaml:"admin_token"`
+	ImapTlsConfiguration         `yaml:",inline"`
+}
+
+// RouteConfiguration overrides the upstreams and backends for the users listed
+// or the users of the domains listed.
+type RouteConfiguration struct {
+	Domains              []string                    `yaml:"domains"`
+	Users                []string                    `yaml:"users"`
+	ImapServer           string                      `yaml:"imap_host"`
+	ImapPort             int                         `yaml:"imap_port"`
+	ImapUpstreams        []ImapUpstreamConfiguration `yaml:"imap_upstreams"`
+	ImapUpstreamStrategy string                      `yaml:"imap_upstream_strategy"`
+	CaCertFile           string                      `yaml:"ca_cert_file"`
+	SmtpServer           string                      `yaml:"smtp_host"`
+	SmtpPort             int                         `yaml:"smtp_port"`
+	SmtpUser             string                      `yaml:"smtp_user"`
+	SmtpPass             string                      `yaml:"smtp_pass"`
+	ImapLoginFormat      string                      `yaml:"imap_login_format"`
+	ImapLoginPassword    string                      `yaml:"imap_login_password"`
+	BackendPolicy        string                      `yaml:"backend_policy"`
+	UpstreamDiscovery    *bool                       `yaml:"upstream_discovery"`
+	Backends             []BackendConfiguration      `yaml:"backends"`
+}
+
+// ImapTlsConfiguration describes how connections to IMAP servers are secured
+// and how long they may take.
+type ImapTlsConfiguration struct {
+	ImapTls               string        `yaml:"imap_tls"`
+	ImapTlsServerName     string        `yaml:"imap_tls_server_name"`
+	ImapTlsMinVersion     string        `yaml:"imap_tls_min_version"`
+	ImapTlsPins           []string      `yaml:"imap_tls_pins"`
+	ImapTlsExtraCaFiles   []string      `yaml:"imap_tls_extra_ca_files"`
+	ImapTlsClientCertFile string        `yaml:"imap_tls_client_cert_file"`
+	ImapTlsClientKeyFile  string        `yaml:"imap_tls_client_key_file"`
+	ImapConnectTimeout    time.Duration `yaml:"imap_connect_timeout"`
+	ImapLoginTimeout      time.Duration `yaml:"imap_login_timeout"`
+}
+
+// UserSubstitutionConfiguration replaces the matches of the regular expression
+// Pattern in the username by Replacement, which may refer to groups via $1.
+type UserSubstitutionConfiguration struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+type ImapUpstreamConfiguration struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+type CacheOverrideConfiguration struct {
+	Ttl         *time.Duration `yaml:"ttl"`
+	NegativeTtl *time.Duration `yaml:"negative_ttl"`
+	Expiry      string         `yaml:"expiry"`
+}
+
+type BackendConfiguration struct {
+	Type                    string        `yaml:"type"`
+	ImapServer              string        `yaml:"imap_host"`
+	ImapPort                int           `yaml:"imap_port"`
+	CaCertFile              string        `yaml:"ca_cert_file"`
+	SqlDriver               string        `yaml:"sql_driver"`
+	SqlDsn                  string        `yaml:"sql_dsn"`
+	SqlQuery                string        `yaml:"sql_query"`
+	DovecotAddress          string        `yaml:"dovecot_address"`
+	RadiusServers           []string      `yaml:"radius_servers"`
+	RadiusSecret            string        `yaml:"radius_secret"`
+	RadiusTimeout           time.Duration `yaml:"radius_timeout"`
+	WebhookUrl              string        `yaml:"webhook_url"`
+	WebhookPasswordEncoding string        `yaml:"webhook_password_encoding"`
+	WebhookTimeout          time.Duration `yaml:"webhook_timeout"`
+	ImapTlsConfiguration    `yaml:",inline"`
 }
 
 func (c *Configuration) applyDefaults() {
@@ -23,6 +140,131 @@ func (c *Configuration) applyDefaults() {
 	if c.CaCertFile == "" {
 		c.CaCertFile = "/etc/ssl/certs/ca-certificates.crt"
 	}
+	c.ImapTlsConfiguration.applyDefaults()
+	if c.ImapUpstreamStrategy == "" {
+		c.ImapUpstreamStrategy = UPSTREAM_STRATEGY_FAILOVER
+	}
+	if c.ImapHealthCheckInterval == 0 {
+		c.ImapHealthCheckInterval = 10 * time.Second
+	}
+	if c.ImapPoolMaxIdle == 0 {
+		c.ImapPoolMaxIdle = 30 * time.Second
+	}
+	if c.CircuitBreakerOpenDuration == 0 {
+		c.CircuitBreakerOpenDuration = 30 * time.Second
+	}
+	if c.CacheStore == "" {
+		c.CacheStore = CACHE_STORE_MEMORY
+	}
+	// zero disables caching, so only a missing value is defaulted
+	if c.CacheTtl == nil {
+		cache_ttl := 15 * time.Minute
+		c.CacheTtl = &cache_ttl
+	}
+	if c.CacheExpiry == "" {
+		c.CacheExpiry = CACHE_EXPIRY_ABSOLUTE
+	}
+	if c.CacheMismatch == "" {
+		c.CacheMismatch = CACHE_MISMATCH_REJECT
+	}
+	// zero disables sweeping, so only a missing value is defaulted
+	if c.CacheSweepInterval == nil {
+		cache_sweep_interval := time.Minute
+		c.CacheSweepInterval = &cache_sweep_interval
+	}
+	if c.CacheStaleRevalidateInterval == 0 {
+		c.CacheStaleRevalidateInterval = 30 * time.Second
+	}
+	if c.CacheHash == "" {
+		c.CacheHash = CACHE_HASH_BCRYPT
+	}
+	if c.CacheHashCost == 0 {
+		c.CacheHashCost = 10
+	}
+	// recommended by OWASP for argon2id
+	if c.CacheHashTime == 0 {
+		c.CacheHashTime = 2
+	}
+	if c.CacheHashMemory == 0 {
+		c.CacheHashMemory = 19 * 1024
+	}
+	if c.CacheHashThreads == 0 {
+		c.CacheHashThreads = 1
+	}
+	if c.CacheRedisKeyPrefix == "" {
+		c.CacheRedisKeyPrefix = "nginxmailauthdelegator:"
+	}
+	if c.BackendPolicy == "" {
+		c.BackendPolicy = POLICY_FIRST_SUCCESS
+	}
+	for i := range c.Backends {
+		c.Backends[i].applyDefaults()
+	}
+	if c.SmtpPort == 0 {
+		c.SmtpPort = DEFAULT_SMTP_PORT
+	}
+	if c.DnsCacheTtl == 0 {
+		c.DnsCacheTtl = DEFAULT_DNS_CACHE_TTL
+	}
+	if c.IpPreference == "" {
+		c.IpPreference = IP_PREFERENCE_IPV4
+	}
+	for i := range c.Routes {
+		c.Routes[i].applyDefaults()
+	}
+}
+
+func (c *ImapTlsConfiguration) applyDefaults() {
+	if c.ImapTls == "" {
+		c.ImapTls = IMAP_TLS_IMPLICIT
+	}
+	if c.ImapTlsMinVersion == "" {
+		c.ImapTlsMinVersion = "1.2"
+	}
+	if c.ImapConnectTimeout == 0 {
+		c.ImapConnectTimeout = 10 * time.Second
+	}
+	if c.ImapLoginTimeout == 0 {
+		c.ImapLoginTimeout = 10 * time.Second
+	}
+}
+
+func (c *RouteConfiguration) applyDefaults() {
+	if c.BackendPolicy == "" {
+		c.BackendPolicy = POLICY_FIRST_SUCCESS
+	}
+	for i := range c.Backends {
+		c.Backends[i].applyDefaults()
+	}
+}
+
+func (c *BackendConfiguration) applyDefaults() {
+	switch c.Type {
+	case BACKEND_TYPE_IMAP:
+		if c.ImapPort == 0 {
+			c.ImapPort = 993
+		}
+		if c.CaCertFile == "" {
+			c.CaCertFile = "/etc/ssl/certs/ca-certificates.crt"
+		}
+		c.ImapTlsConfiguration.applyDefaults()
+	case BACKEND_TYPE_SQL:
+		if c.SqlQuery == "" {
+			c.SqlQuery = DEFAULT_SQL_QUERY
+		}
+	case BACKEND_TYPE_RADIUS:
+		if c.RadiusTimeout == 0 {
+			c.RadiusTimeout = 30 * time.Second
+		}
+	case BACKEND_TYPE_WEBHOOK:
+		// the password is only sent in clear text if explicitly configured
+		if c.WebhookPasswordEncoding == "" {
+			c.WebhookPasswordEncoding = WEBHOOK_PASSWORD_SHA256
+		}
+		if c.WebhookTimeout == 0 {
+			c.WebhookTimeout = 10 * time.Second
+		}
+	}
 }
 
 func (c *Configuration) Load(file_path string) error {
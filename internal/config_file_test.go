@@ -2,6 +2,7 @@ package internal
 
 import (
 	"testing"
+	"time"
 
 	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
 )
@@ -30,9 +31,27 @@ func TestReadingConfigFile(t *testing.T) {
 	asserts.AssertEquals(t, "smtp.example.org", cfg.SmtpServer)
 	asserts.AssertEquals(t, "barfoo", cfg.SmtpUser)
 	asserts.AssertEquals(t, "foobar", cfg.SmtpPass)
+	asserts.AssertEquals(t, CACHE_STORE_MEMORY, cfg.CacheStore)
+	asserts.AssertEquals(t, 15*time.Minute, *cfg.CacheTtl)
+	asserts.AssertEquals(t, time.Minute, *cfg.CacheSweepInterval)
+	asserts.AssertEquals(t, CACHE_EXPIRY_ABSOLUTE, cfg.CacheExpiry)
 	asserts.AssertStringArraysEquals(t, expected_users[:], cfg.WhitelistedUsers)
 }
 
+func TestReadingConfigFileWithUserRewriting(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_users.yaml")
+
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, true, cfg.UserLowercase)
+	asserts.AssertEquals(t, "example.org", cfg.UserDefaultDomain)
+	asserts.AssertEquals(t, 1, len(cfg.UserSubstitutions))
+	asserts.AssertEquals(t, `^([^+@]+)\+[^@]*@`, cfg.UserSubstitutions[0].Pattern)
+	asserts.AssertEquals(t, "$1@", cfg.UserSubstitutions[0].Replacement)
+	asserts.AssertEquals(t, "admin@example.org", cfg.UserAliases["postmaster@example.org"])
+	asserts.AssertEquals(t, true, cfg.UserReturnCanonical)
+}
+
 func TestConfigDefaults(t *testing.T) {
 	var cfg Configuration
 	// Test that defaults are applied when fields are not set
@@ -67,3 +86,98 @@ func TestReadingConfigFileWithCustomValues(t *testing.T) {
 	asserts.AssertEquals(t, "barfoo", cfg.SmtpUser)
 	asserts.AssertEquals(t, "foobar", cfg.SmtpPass)
 }
+
+func TestReadingConfigFileWithBackends(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_backends.yaml")
+
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, POLICY_FALLBACK, cfg.BackendPolicy)
+	asserts.AssertEquals(t, 3, len(cfg.Backends))
+	asserts.AssertEquals(t, "old-imap.example.org", cfg.Backends[0].ImapServer)
+	asserts.AssertEquals(t, 993, cfg.Backends[0].ImapPort)
+	asserts.AssertEquals(t, "/etc/ssl/certs/ca-certificates.crt", cfg.Backends[0].CaCertFile)
+	asserts.AssertEquals(t, "new-imap.example.org", cfg.Backends[1].ImapServer)
+	asserts.AssertEquals(t, 1993, cfg.Backends[1].ImapPort)
+	asserts.AssertEquals(t, "/custom/path/ca.crt", cfg.Backends[1].CaCertFile)
+	asserts.AssertStringArraysEquals(t, []string{"radius1.example.org:1812", "radius2.example.org:1812"}, cfg.Backends[2].RadiusServers)
+	asserts.AssertEquals(t, "secret", cfg.Backends[2].RadiusSecret)
+	asserts.AssertEquals(t, 5*time.Second, cfg.Backends[2].RadiusTimeout)
+}
+
+func TestReadingConfigFileWithCacheSettings(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_cache.yaml")
+
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, time.Hour, *cfg.CacheTtl)
+	asserts.AssertEquals(t, 30*time.Second, cfg.CacheNegativeTtl)
+	asserts.AssertEquals(t, "secret", cfg.CacheNegativeSecret)
+	asserts.AssertEquals(t, CACHE_EXPIRY_SLIDING, cfg.CacheExpiry)
+	asserts.AssertEquals(t, time.Duration(0), *cfg.CacheUserOverrides["some_user"].Ttl)
+	asserts.AssertEquals(t, true, cfg.CacheUserOverrides["some_user"].NegativeTtl == nil)
+	asserts.AssertEquals(t, time.Minute, *cfg.CacheUserOverrides["other_user"].NegativeTtl)
+	asserts.AssertEquals(t, CACHE_EXPIRY_ABSOLUTE, cfg.CacheUserOverrides["other_user"].Expiry)
+}
+
+func TestReadingConfigFileWithCacheDisabled(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_cache_disabled.yaml")
+
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, time.Duration(0), *cfg.CacheTtl)
+	asserts.AssertEquals(t, time.Duration(0), *cfg.CacheSweepInterval)
+}
+
+func TestReadingConfigFileWithImapUpstreams(t *testing.T) {
+	var cfg Configuration
+	err := cfg.Load("testdata/config_upstreams.yaml")
+
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 2, len(cfg.ImapUpstreams))
+	asserts.AssertEquals(t, "imap1.example.org", cfg.ImapUpstreams[0].Host)
+	asserts.AssertEquals(t, 0, cfg.ImapUpstreams[0].Port)
+	asserts.AssertEquals(t, "imap2.example.org", cfg.ImapUpstreams[1].Host)
+	asserts.AssertEquals(t, 1993, cfg.ImapUpstreams[1].Port)
+	asserts.AssertEquals(t, UPSTREAM_STRATEGY_ROUND_ROBIN, cfg.ImapUpstreamStrategy)
+	asserts.AssertEquals(t, 30*time.Second, cfg.ImapHealthCheckInterval)
+}
+
+func TestImapPoolDefaults(t *testing.T) {
+	var cfg Configuration
+	cfg.applyDefaults()
+
+	asserts.AssertEquals(t, 0, cfg.ImapPoolSize)
+	asserts.AssertEquals(t, 30*time.Second, cfg.ImapPoolMaxIdle)
+}
+
+func TestCircuitBreakerDefaults(t *testing.T) {
+	var cfg Configuration
+	cfg.applyDefaults()
+
+	asserts.AssertEquals(t, 0, cfg.CircuitBreakerThreshold)
+	asserts.AssertEquals(t, 30*time.Second, cfg.CircuitBreakerOpenDuration)
+}
+
+func TestWebhookDefaults(t *testing.T) {
+	var cfg Configuration
+	cfg.Backends = []BackendConfiguration{{Type: BACKEND_TYPE_WEBHOOK}, {Type: BACKEND_TYPE_WEBHOOK, WebhookPasswordEncoding: WEBHOOK_PASSWORD_PLAIN}}
+	cfg.applyDefaults()
+
+	asserts.AssertEquals(t, WEBHOOK_PASSWORD_SHA256, cfg.Backends[0].WebhookPasswordEncoding)
+	asserts.AssertEquals(t, WEBHOOK_PASSWORD_PLAIN, cfg.Backends[1].WebhookPasswordEncoding)
+	asserts.AssertEquals(t, 10*time.Second, cfg.Backends[0].WebhookTimeout)
+}
+
+func TestImapTlsDefaults(t *testing.T) {
+	var cfg Configuration
+	cfg.Backends = []BackendConfiguration{{Type: BACKEND_TYPE_IMAP, ImapTlsConfiguration: ImapTlsConfiguration{ImapTls: IMAP_TLS_STARTTLS}}}
+	cfg.applyDefaults()
+
+	asserts.AssertEquals(t, IMAP_TLS_IMPLICIT, cfg.ImapTls)
+	asserts.AssertEquals(t, "1.2", cfg.ImapTlsMinVersion)
+	asserts.AssertEquals(t, IMAP_TLS_STARTTLS, cfg.Backends[0].ImapTls)
+	asserts.AssertEquals(t, "1.2", cfg.Backends[0].ImapTlsMinVersion)
+	asserts.AssertEquals(t, 10*time.Second, cfg.ImapConnectTimeout)
+	asserts.AssertEquals(t, 10*time.Second, cfg.Backends[0].ImapLoginTimeout)
+}
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"bufio"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -37,7 +39,7 @@ func generateSelfSignedCert(host string) (certPEM, keyPEM []byte, err error) {
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		DNSNames:              []string{host},
 		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
@@ -65,14 +67,18 @@ func generateSelfSignedCert(host string) (certPEM, keyPEM []byte, err error) {
 // startTestIMAPServer starts an embedded IMAP server wrapped in TLS
 // Returns the port, the certificate PEM, and a function to stop the server
 // The server has a default user "username" with password "password"
-func startTestIMAPServer(t *testing.T) (int, []byte, func()) {
+func startTestIMAPServer(t testing.TB) (int, []byte, func()) {
 	// Generate self-signed certificate
 	certPEM, keyPEM, err := generateSelfSignedCert("localhost")
-	asserts.AssertNil(t, err)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
 
 	// Create TLS certificate
 	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	asserts.AssertNil(t, err)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
 
 	// Create TLS config
 	tlsConfig := &tls.Config{
@@ -123,9 +129,9 @@ func TestCredentialsValidInImap_ValidCredentials(t *testing.T) {
 	asserts.AssertNil(t, err)
 
 	// Test with valid credentials (using the default "username"/"password" from memory backend)
-	valid, ok := credentialsValidInImap("127.0.0.1", port, "username", "password", tmpFile)
-	asserts.AssertEquals(t, true, ok)
-	asserts.AssertEquals(t, true, valid)
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, tmpFile, ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
 }
 
 func TestCredentialsValidInImap_InvalidCredentials(t *testing.T) {
@@ -138,9 +144,9 @@ func TestCredentialsValidInImap_InvalidCredentials(t *testing.T) {
 	asserts.AssertNil(t, err)
 
 	// Test with invalid credentials
-	valid, ok := credentialsValidInImap("127.0.0.1", port, "username", "wrongpass", tmpFile)
-	asserts.AssertEquals(t, true, ok)
-	asserts.AssertEquals(t, false, valid)
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "wrongpass", createTestTlsSettings(t, tmpFile, ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
 }
 
 func TestCredentialsValidInImap_InvalidCert(t *testing.T) {
@@ -157,9 +163,9 @@ func TestCredentialsValidInImap_InvalidCert(t *testing.T) {
 	asserts.AssertNil(t, err)
 
 	// Test should fail because the certificate is not trusted
-	valid, ok := credentialsValidInImap("127.0.0.1", port, "username", "password", tmpFile)
-	asserts.AssertEquals(t, false, ok)
-	asserts.AssertEquals(t, false, valid)
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, tmpFile, ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
 }
 
 func TestCredentialsValidInImap_ServerUnavailable(t *testing.T) {
@@ -180,7 +186,87 @@ func TestCredentialsValidInImap_ServerUnavailable(t *testing.T) {
 	asserts.AssertNil(t, err)
 
 	// Test should fail because no server is listening
-	valid, ok := credentialsValidInImap("127.0.0.1", port, "username", "password", tmpFile)
-	asserts.AssertEquals(t, false, ok)
-	asserts.AssertEquals(t, false, valid)
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, tmpFile, ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+// startHangingServer accepts connections, optionally greets and then does not
+// answer anymore.
+func startHangingServer(t *testing.T, greet bool) (int, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	asserts.AssertNil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if greet {
+				conn.Write([]byte("* OK [CAPABILITY IMAP4rev1] ready\r\n"))
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, func() {
+		listener.Close()
+	}
+}
+
+func TestCredentialsValidInImap_ConnectTimeout(t *testing.T) {
+	port, stop := startHangingServer(t, false)
+	defer stop()
+
+	tls_settings := createTestTlsSettings(t, "", ImapTlsConfiguration{ImapConnectTimeout: 200 * time.Millisecond})
+	start := time.Now()
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+	asserts.AssertEquals(t, true, time.Since(start) < 5*time.Second)
+}
+
+func TestCredentialsValidInImap_LoginTimeout(t *testing.T) {
+	port, stop := startHangingServer(t, true)
+	defer stop()
+
+	tls_settings := ImapTlsSettings{Mode: IMAP_TLS_NONE, ConnectTimeout: 5 * time.Second, LoginTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+	asserts.AssertEquals(t, true, time.Since(start) < 5*time.Second)
+}
+
+func TestCredentialsValidInImap_Canceled(t *testing.T) {
+	port, stop := startHangingServer(t, true)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := credentialsValidInImap(ctx, "127.0.0.1", port, "username", "password", ImapTlsSettings{Mode: IMAP_TLS_NONE})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+	asserts.AssertEquals(t, true, time.Since(start) < 5*time.Second)
+}
+
+func TestCredentialsValidInImap_ConnectionLost(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	asserts.AssertNil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// closes the connection instead of answering the login
+		conn.Write([]byte("* OK [CAPABILITY IMAP4rev1] ready\r\n"))
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", ImapTlsSettings{Mode: IMAP_TLS_NONE, LoginTimeout: 5 * time.Second})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Timeout)
 }
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DOVECOT_TIMEOUT = 5 * time.Second
+
+// createDovecotBackend validates credentials via the auth-client protocol of
+// Dovecot. Addresses starting with a slash are unix sockets, all others are
+// TCP addresses (host:port).
+func createDovecotBackend(address string) CredentialsValidator {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	return func(request ValidationRequest) ValidationResult {
+		// the earlier of the deadline of the request and the timeout applies
+		ctx, cancel := context.WithTimeout(request.Context(), DOVECOT_TIMEOUT)
+		defer cancel()
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			log.Printf("connecting to dovecot failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false, Timeout: isTimeout(ctx, err)}
+		}
+		defer conn.Close()
+
+		deadline, _ := ctx.Deadline()
+		conn.SetDeadline(deadline)
+		stop := context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Now())
+		})
+		defer stop()
+
+		result, err := authenticateAtDovecot(conn, request)
+		if err != nil {
+			log.Printf("authenticating at dovecot failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false, Timeout: isTimeout(ctx, err)}
+		}
+		return result
+	}
+}
+
+func authenticateAtDovecot(conn net.Conn, request ValidationRequest) (ValidationResult, error) {
+	reader := bufio.NewReader(conn)
+
+	// handshake
+	if _, err := fmt.Fprintf(conn, "VERSION\t1\t2\nCPID\t%d\n", os.Getpid()); err != nil {
+		return ValidationResult{}, err
+	}
+	plain_supported := false
+	for done := false; !done; {
+		fields, err := readDovecotLine(reader)
+		if err != nil {
+			return ValidationResult{}, err
+		}
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) < 2 || fields[1] != "1" {
+				return ValidationResult{}, fmt.Errorf("unsupported protocol version %v", fields[1:])
+			}
+		case "MECH":
+			plain_supported = plain_supported || (len(fields) > 1 && fields[1] == "PLAIN")
+		case "DONE":
+			done = true
+		}
+	}
+	if !plain_supported {
+		return ValidationResult{}, fmt.Errorf("mechanism PLAIN not supported")
+	}
+
+	// authentication
+	response := base64.StdEncoding.EncodeToString([]byte("\x00" + request.User + "\x00" + request.Pass))
+	parameters := "service=" + escapeDovecotValue(request.Protocol)
+	if request.ClientIp != "" {
+		parameters += "\trip=" + escapeDovecotValue(request.ClientIp)
+	}
+	if _, err := fmt.Fprintf(conn, "AUTH\t1\tPLAIN\t%s\tresp=%s\n", parameters, response); err != nil {
+		return ValidationResult{}, err
+	}
+	for {
+		fields, err := readDovecotLine(reader)
+		if err != nil {
+			return ValidationResult{}, err
+		}
+		if len(fields) < 2 || fields[1] != "1" {
+			continue
+		}
+
+		user_fields := parseDovecotFields(fields[2:])
+		switch fields[0] {
+		case "OK":
+			return createDovecotResult(user_fields), nil
+		case "FAIL":
+			// temporary failures (e.g. database down) do not allow a decision
+			_, temporary := user_fields["temp"]
+			return ValidationResult{Decision: false, Valid: !temporary}, nil
+		default:
+			return ValidationResult{}, fmt.Errorf("unexpected response %v", fields[0])
+		}
+	}
+}
+
+// route the user if dovecot proxies it to another host
+func createDovecotResult(user_fields map[string]string) ValidationResult {
+	result := ValidationResult{Decision: true, Valid: true}
+	if _, proxy := user_fields["proxy"]; proxy {
+		result.Server = user_fields["host"]
+		result.Port, _ = strconv.Atoi(user_fields["port"])
+	}
+	return result
+}
+
+func readDovecotLine(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(line, "\r\n"), "\t"), nil
+}
+
+func parseDovecotFields(fields []string) map[string]string {
+	user_fields := make(map[string]string)
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		user_fields[key] = unescapeDovecotValue(value)
+	}
+	return user_fields
+}
+
+var dovecotEscaper = strings.NewReplacer("\x01", "\x011", "\t", "\x01t", "\r", "\x01r", "\n", "\x01n")
+var dovecotUnescaper = strings.NewReplacer("\x011", "\x01", "\x01t", "\t", "\x01r", "\r", "\x01n", "\n")
+
+func escapeDovecotValue(value string) string {
+	return dovecotEscaper.Replace(value)
+}
+
+func unescapeDovecotValue(value string) string {
+	return dovecotUnescaper.Replace(value)
+}
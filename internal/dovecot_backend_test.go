@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+// startTestDovecotServer starts a fake dovecot auth server on a unix socket
+// Returns the socket path and a function to stop the server
+// The server accepts "username"/"password", proxies "proxied"/"password",
+// accepts "remote"/"password" only from 192.0.2.1 and fails temporarily for
+// "tempfail"
+func startTestDovecotServer(t *testing.T) (string, func()) {
+	socket := t.TempDir() + "/auth-client"
+	listener, err := net.Listen("unix", socket)
+	asserts.AssertNil(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestDovecotConnection(conn)
+		}
+	}()
+
+	return socket, func() {
+		listener.Close()
+	}
+}
+
+func serveTestDovecotConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "VERSION\t1\t2\nMECH\tPLAIN\tplaintext\nMECH\tLOGIN\tplaintext\nSPID\t1\nCUID\t1\nCOOKIE\t0123\nDONE\n")
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if fields[0] != "AUTH" {
+			continue
+		}
+
+		id := fields[1]
+		var user, pass, rip string
+		for _, field := range fields[3:] {
+			if value, found := strings.CutPrefix(field, "rip="); found {
+				rip = value
+			}
+			if response, found := strings.CutPrefix(field, "resp="); found {
+				decoded, _ := base64.StdEncoding.DecodeString(response)
+				parts := strings.Split(string(decoded), "\x00")
+				user, pass = parts[1], parts[2]
+			}
+		}
+
+		switch {
+		case user == "tempfail":
+			fmt.Fprintf(conn, "FAIL\t%s\tuser=%s\ttemp\n", id, user)
+		case user == "remote" && pass == "password" && rip == "192.0.2.1":
+			fmt.Fprintf(conn, "OK\t%s\tuser=%s\n", id, user)
+		case user == "username" && pass == "password":
+			fmt.Fprintf(conn, "OK\t%s\tuser=%s\n", id, user)
+		case user == "proxied" && pass == "password":
+			fmt.Fprintf(conn, "OK\t%s\tuser=%s\tproxy\thost=imap2.example.org\tport=1993\n", id, user)
+		default:
+			fmt.Fprintf(conn, "FAIL\t%s\tuser=%s\n", id, user)
+		}
+	}
+}
+
+func TestDovecotBackendValidCredentials(t *testing.T) {
+	socket, stop := startTestDovecotServer(t)
+	defer stop()
+
+	result := createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertEquals(t, "", result.Server)
+}
+
+func TestDovecotBackendInvalidCredentials(t *testing.T) {
+	socket, stop := startTestDovecotServer(t)
+	defer stop()
+
+	result := createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "username", Pass: "wrongpass"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestDovecotBackendTemporaryFailure(t *testing.T) {
+	socket, stop := startTestDovecotServer(t)
+	defer stop()
+
+	result := createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "tempfail", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestDovecotBackendProxiedUser(t *testing.T) {
+	socket, stop := startTestDovecotServer(t)
+	defer stop()
+
+	result := createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "proxied", Pass: "password"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertEquals(t, "imap2.example.org", result.Server)
+	asserts.AssertEquals(t, 1993, result.Port)
+}
+
+func TestDovecotBackendServerUnavailable(t *testing.T) {
+	result := createDovecotBackend(t.TempDir() + "/doesnotexist")(ValidationRequest{Protocol: "imap", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestDovecotBackendSendsClientIp(t *testing.T) {
+	socket, stop := startTestDovecotServer(t)
+	defer stop()
+
+	result := createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "remote", Pass: "password", ClientIp: "192.0.2.1"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	result = createDovecotBackend(socket)(ValidationRequest{Protocol: "imap", User: "remote", Pass: "password", ClientIp: "192.0.2.2"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestDovecotBackendStopsAtDeadlineOfRequest(t *testing.T) {
+	// the server never answers
+	socket := t.TempDir() + "/auth-client"
+	listener, err := net.Listen("unix", socket)
+	asserts.AssertNil(t, err)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := createDovecotBackend(socket)(ValidationRequest{Ctx: ctx, Protocol: "imap", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+	asserts.AssertEquals(t, true, time.Since(start) < DOVECOT_TIMEOUT)
+}
+
+func TestDovecotValueEscaping(t *testing.T) {
+	value := "a\tb\nc\x01d"
+	asserts.AssertEquals(t, "a\x01tb\x01nc\x011d", escapeDovecotValue(value))
+	asserts.AssertEquals(t, value, unescapeDovecotValue(escapeDovecotValue(value)))
+}
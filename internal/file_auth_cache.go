@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// changes are written at most once per interval, so that logins do not wait
+// for the disk
+const FILE_CACHE_WRITE_INTERVAL = time.Second
+
+type persistedAuthCacheEntry struct {
+	Key          string    `json:"key"`
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"password_hash"`
+	Expiry       time.Time `json:"expiry"`
+	Server       string    `json:"server,omitempty"`
+	Port         int       `json:"port,omitempty"`
+	UpstreamUser string    `json:"upstream_user,omitempty"`
+	Negative     bool      `json:"negative,omitempty"`
+}
+
+// fileAuthCache keeps all entries in memory and writes them to a JSON file in
+// the background, so that the cache survives restarts. Changes of the last
+// FILE_CACHE_WRITE_INTERVAL are lost if the process crashes.
+type fileAuthCache struct {
+	memoryAuthCache
+	file_path   string
+	dirty       bool
+	write_mutex sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func createFileAuthCache(file_path string, max_entries int, stale_grace time.Duration, evictions *atomic.Uint64) (*fileAuthCache, error) {
+	cache := &fileAuthCache{
+		memoryAuthCache: memoryAuthCache{
+			entries:     make(map[string]authCacheEntry),
+			max_entries: max_entries,
+			evictions:   evictions,
+		},
+		file_path: file_path,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	content, err := os.ReadFile(file_path)
+	if errors.Is(err, os.ErrNotExist) {
+		cache.startWriter()
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var persisted_entries []persistedAuthCacheEntry
+	if err := json.Unmarshal(content, &persisted_entries); err != nil {
+		return nil, err
+	}
+
+	// skip entries that expired while not running
+	now := time.Now()
+	for _, persisted_entry := range persisted_entries {
+		entry := authCacheEntry{
+			username:      persisted_entry.Username,
+			password_hash: persisted_entry.PasswordHash,
+			expiry:        persisted_entry.Expiry,
+			server:        persisted_entry.Server,
+			port:          persisted_entry.Port,
+			upstream_user: persisted_entry.UpstreamUser,
+			negative:      persisted_entry.Negative,
+		}
+		if entry.removalTime(stale_grace).Before(now) {
+			continue
+		}
+		cache.putLocked(persisted_entry.Key, entry)
+	}
+
+	// the pruned entries are written right away
+	cache.dirty = true
+	if err := cache.write(); err != nil {
+		return nil, err
+	}
+	cache.startWriter()
+	return cache, nil
+}
+
+// startWriter writes the changes every FILE_CACHE_WRITE_INTERVAL until the
+// cache is closed.
+func (cache *fileAuthCache) startWriter() {
+	go func() {
+		defer close(cache.done)
+		ticker := time.NewTicker(FILE_CACHE_WRITE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cache.stop:
+				return
+			case <-ticker.C:
+				if err := cache.write(); err != nil {
+					log.Printf("writing cache file failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (cache *fileAuthCache) put(key string, entry authCacheEntry) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.putLocked(key, entry)
+	cache.dirty = true
+	return nil
+}
+
+func (cache *fileAuthCache) delete(key string) error {
+	return cache.deleteAll([]string{key})
+}
+
+func (cache *fileAuthCache) deleteAll(keys []string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, key := range keys {
+		delete(cache.entries, key)
+	}
+	cache.dirty = true
+	return nil
+}
+
+// close stops the background writer and writes the remaining changes.
+func (cache *fileAuthCache) close() error {
+	close(cache.stop)
+	<-cache.done
+	return cache.write()
+}
+
+// write replaces the file by the current entries if they changed since the
+// last write. The entries are only locked while copying them.
+func (cache *fileAuthCache) write() error {
+	cache.write_mutex.Lock()
+	defer cache.write_mutex.Unlock()
+
+	cache.mutex.Lock()
+	if !cache.dirty {
+		cache.mutex.Unlock()
+		return nil
+	}
+	persisted_entries := make([]persistedAuthCacheEntry, 0, len(cache.entries))
+	for key, entry := range cache.entries {
+		persisted_entries = append(persisted_entries, persistedAuthCacheEntry{
+			Key:          key,
+			Username:     entry.username,
+			PasswordHash: entry.password_hash,
+			Expiry:       entry.expiry,
+			Server:       entry.server,
+			Port:         entry.port,
+			UpstreamUser: entry.upstream_user,
+			Negative:     entry.negative,
+		})
+	}
+	cache.dirty = false
+	cache.mutex.Unlock()
+
+	err := writeFileAtomically(cache.file_path, persisted_entries)
+	if err != nil {
+		// try again with the next write
+		cache.mutex.Lock()
+		cache.dirty = true
+		cache.mutex.Unlock()
+	}
+	return err
+}
+
+func writeFileAtomically(file_path string, persisted_entries []persistedAuthCacheEntry) error {
+	content, err := json.Marshal(persisted_entries)
+	if err != nil {
+		return err
+	}
+
+	// replace the file atomically, so that a crash never leaves a broken cache
+	tmp_file, err := os.CreateTemp(filepath.Dir(file_path), filepath.Base(file_path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp_file.Name())
+	if _, err := tmp_file.Write(content); err != nil {
+		tmp_file.Close()
+		return err
+	}
+	if err := tmp_file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_file.Name(), file_path)
+}
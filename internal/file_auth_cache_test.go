@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestFileAuthCacheSurvivesRestart(t *testing.T) {
+	file_path := t.TempDir() + "/cache.json"
+	cache, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+
+	expiry := time.Now().Add(time.Hour).Round(0)
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: expiry, server: "imap2.example.org", port: 1993, upstream_user: "test*master"}))
+	asserts.AssertNil(t, cache.put("deleted", authCacheEntry{username: "deleted", password_hash: []byte("hash"), expiry: expiry}))
+	asserts.AssertNil(t, cache.delete("deleted"))
+	asserts.AssertNil(t, cache.close())
+
+	cache, err = createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	entry, found := cache.get("test")
+	asserts.AssertEquals(t, true, found)
+	asserts.AssertEquals(t, "hash", string(entry.password_hash))
+	asserts.AssertEquals(t, true, expiry.Equal(entry.expiry))
+	asserts.AssertEquals(t, "imap2.example.org", entry.server)
+	asserts.AssertEquals(t, 1993, entry.port)
+	asserts.AssertEquals(t, "test*master", entry.upstream_user)
+	_, found = cache.get("deleted")
+	asserts.AssertEquals(t, false, found)
+	asserts.AssertNil(t, cache.close())
+}
+
+func TestFileAuthCacheCoalescesWrites(t *testing.T) {
+	file_path := t.TempDir() + "/cache.json"
+	cache, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	defer cache.close()
+
+	expiry := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		asserts.AssertNil(t, cache.put(key, authCacheEntry{username: key, password_hash: []byte("hash"), expiry: expiry}))
+	}
+	asserts.AssertNil(t, cache.deleteAll([]string{"a", "b"}))
+	_, err = os.Stat(file_path)
+	asserts.AssertEquals(t, true, os.IsNotExist(err))
+
+	// the changes are written in the background
+	time.Sleep(FILE_CACHE_WRITE_INTERVAL + 500*time.Millisecond)
+	restored, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	defer restored.close()
+	entries, err := restored.list()
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, len(entries))
+	_, found := entries["c"]
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestFileAuthCachePrunesExpiredEntries(t *testing.T) {
+	file_path := t.TempDir() + "/cache.json"
+	cache, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	asserts.AssertNil(t, cache.put("expired", authCacheEntry{username: "expired", password_hash: []byte("hash"), expiry: time.Now().Add(-time.Second)}))
+	asserts.AssertNil(t, cache.close())
+
+	cache, err = createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	_, found := cache.get("expired")
+	asserts.AssertEquals(t, false, found)
+
+	content, err := os.ReadFile(file_path)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "[]", string(content))
+}
+
+func TestFileAuthCacheKeepsStaleEntries(t *testing.T) {
+	file_path := t.TempDir() + "/cache.json"
+	cache, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	asserts.AssertNil(t, cache.put("stale", authCacheEntry{username: "stale", password_hash: []byte("hash"), expiry: time.Now().Add(-time.Second)}))
+	asserts.AssertNil(t, cache.close())
+
+	// the backends may be unreachable on restart
+	cache, err = createFileAuthCache(file_path, 0, time.Minute, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	_, found := cache.get("stale")
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestFileAuthCacheMissingFile(t *testing.T) {
+	cache, err := createFileAuthCache(t.TempDir()+"/doesnotexist.json", 0, 0, &atomic.Uint64{})
+	asserts.AssertNil(t, err)
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestFileAuthCacheBrokenFile(t *testing.T) {
+	file_path := t.TempDir() + "/cache.json"
+	asserts.AssertNil(t, os.WriteFile(file_path, []byte("{broken"), 0600))
+	_, err := createFileAuthCache(file_path, 0, 0, &atomic.Uint64{})
+	asserts.AssertNonNil(t, err)
+}
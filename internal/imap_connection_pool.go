@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapConnectionPool keeps connections to the IMAP upstreams established, so
+// that a validation only has to log in. A connection is only used for a single
+// login and replaced in the background afterwards, because IMAP does not allow
+// to log in again once authenticated.
+type imapConnectionPool struct {
+	size     int
+	max_idle time.Duration
+	mutex    sync.Mutex
+	idle     map[string][]idleImapConnection
+	pending  map[string]int
+	closed   bool
+	running  sync.WaitGroup
+}
+
+type idleImapConnection struct {
+	client      *client.Client
+	established time.Time
+}
+
+func createImapConnectionPool(size int, max_idle time.Duration) *imapConnectionPool {
+	return &imapConnectionPool{
+		size:     size,
+		max_idle: max_idle,
+		idle:     make(map[string][]idleImapConnection),
+		pending:  make(map[string]int),
+	}
+}
+
+// validate is an ImapValidator that logs in on a pooled connection if there is
+// one and connects otherwise. A pooled connection that was closed by the server
+// meanwhile is replaced by a new one.
+func (pool *imapConnectionPool) validate(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+	address := net.JoinHostPort(imap_host, strconv.Itoa(imap_port))
+	key := poolKey(address, tls_settings)
+	defer pool.refill(key, address, tls_settings)
+
+	imap_client := pool.take(key)
+	if imap_client == nil {
+		return credentialsValidInImap(ctx, imap_host, imap_port, user, pass, tls_settings)
+	}
+	result := loginToImap(ctx, imap_client, address, user, pass, tls_settings)
+	if !result.Valid && !result.Timeout && ctx.Err() == nil {
+		return credentialsValidInImap(ctx, imap_host, imap_port, user, pass, tls_settings)
+	}
+	return result
+}
+
+// take removes an idle connection that can still log in from the pool.
+// return: the connection or nil if there is none
+func (pool *imapConnectionPool) take(key string) *client.Client {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for len(pool.idle[key]) > 0 {
+		connection := pool.idle[key][0]
+		pool.idle[key] = pool.idle[key][1:]
+		if time.Since(connection.established) < pool.max_idle && connection.client.State() == imap.NotAuthenticatedState {
+			return connection.client
+		}
+		connection.client.Terminate()
+	}
+	return nil
+}
+
+// refill establishes connections in the background until the pool is full.
+func (pool *imapConnectionPool) refill(key, address string, tls_settings ImapTlsSettings) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for !pool.closed && len(pool.idle[key])+pool.pending[key] < pool.size {
+		pool.pending[key]++
+		pool.running.Add(1)
+		go func() {
+			defer pool.running.Done()
+			imap_client, err := connectToImap(context.Background(), address, tls_settings)
+			if err != nil {
+				log.Printf("connecting to %v for the pool failed: %v", address, err)
+			}
+
+			pool.mutex.Lock()
+			defer pool.mutex.Unlock()
+			pool.pending[key]--
+			if imap_client == nil {
+				return
+			}
+			if pool.closed {
+				imap_client.Terminate()
+				return
+			}
+			pool.idle[key] = append(pool.idle[key], idleImapConnection{client: imap_client, established: time.Now()})
+		}()
+	}
+}
+
+// idleConnections counts the idle connections to the address.
+func (pool *imapConnectionPool) idleConnections(key string) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.idle[key])
+}
+
+// Close terminates all idle connections and waits for connections being
+// established.
+func (pool *imapConnectionPool) Close() {
+	pool.mutex.Lock()
+	pool.closed = true
+	for key, connections := range pool.idle {
+		for _, connection := range connections {
+			connection.client.Terminate()
+		}
+		delete(pool.idle, key)
+	}
+	pool.mutex.Unlock()
+	pool.running.Wait()
+}
+
+// poolKey separates connections to the same address that are secured
+// differently.
+func poolKey(address string, tls_settings ImapTlsSettings) string {
+	return fmt.Sprintf("%v|%v|%p", address, tls_settings.Mode, tls_settings.Config)
+}
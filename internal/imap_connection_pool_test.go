@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func waitForIdleConnections(t testing.TB, pool *imapConnectionPool, key string, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.idleConnections(key) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v idle connections but got %v", expected, pool.idleConnections(key))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImapConnectionPoolValidatesCredentials(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{})
+	key := poolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+
+	pool := createImapConnectionPool(2, time.Minute)
+	defer pool.Close()
+
+	// the first validation connects itself and fills the pool
+	result := pool.validate(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	waitForIdleConnections(t, pool, key, 2)
+
+	result = pool.validate(context.Background(), "127.0.0.1", port, "username", "wrongpass", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+
+	result = pool.validate(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	waitForIdleConnections(t, pool, key, 2)
+}
+
+func TestImapConnectionPoolReplacesClosedConnections(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{})
+	key := poolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+
+	pool := createImapConnectionPool(1, time.Minute)
+	defer pool.Close()
+	pool.refill(key, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+	waitForIdleConnections(t, pool, key, 1)
+
+	pool.mutex.Lock()
+	idle_client := pool.idle[key][0].client
+	pool.mutex.Unlock()
+	idle_client.Terminate()
+	<-idle_client.LoggedOut()
+
+	result := pool.validate(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestImapConnectionPoolDiscardsIdleConnections(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{})
+	key := poolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+
+	pool := createImapConnectionPool(1, time.Nanosecond)
+	defer pool.Close()
+	pool.refill(key, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+	waitForIdleConnections(t, pool, key, 1)
+
+	asserts.AssertEquals(t, true, pool.take(key) == nil)
+	asserts.AssertEquals(t, 0, pool.idleConnections(key))
+}
+
+func TestImapConnectionPoolClose(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{})
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	key := poolKey(address, tls_settings)
+
+	pool := createImapConnectionPool(2, time.Minute)
+	pool.refill(key, address, tls_settings)
+	waitForIdleConnections(t, pool, key, 2)
+
+	pool.Close()
+	asserts.AssertEquals(t, 0, pool.idleConnections(key))
+
+	// nothing is established after closing
+	pool.refill(key, address, tls_settings)
+	asserts.AssertEquals(t, 0, pool.pending[key])
+	asserts.AssertEquals(t, 0, pool.idleConnections(key))
+}
+
+func TestPoolKeySeparatesTlsSettings(t *testing.T) {
+	implicit := createTestTlsSettings(t, "", ImapTlsConfiguration{})
+	other := createTestTlsSettings(t, "", ImapTlsConfiguration{})
+	none := createTestTlsSettings(t, "", ImapTlsConfiguration{ImapTls: IMAP_TLS_NONE})
+
+	asserts.AssertEquals(t, poolKey("localhost:993", implicit), poolKey("localhost:993", implicit))
+	asserts.AssertNotEquals(t, poolKey("localhost:993", implicit), poolKey("localhost:993", other))
+	asserts.AssertNotEquals(t, poolKey("localhost:993", implicit), poolKey("localhost:993", none))
+	asserts.AssertNotEquals(t, poolKey("localhost:993", implicit), poolKey("localhost:143", implicit))
+}
+
+func createBenchmarkTlsSettings(b *testing.B, certPEM []byte) ImapTlsSettings {
+	ca_cert_file := b.TempDir() + "/ca.crt"
+	if err := os.WriteFile(ca_cert_file, certPEM, 0644); err != nil {
+		b.Fatal(err)
+	}
+	cfg := ImapTlsConfiguration{}
+	cfg.applyDefaults()
+	tls_settings, err := createImapTlsSettings(ca_cert_file, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return tls_settings
+}
+
+func BenchmarkCredentialsValidInImapWithoutSessionResumption(b *testing.B) {
+	port, certPEM, stop := startTestIMAPServer(b)
+	defer stop()
+	tls_settings := createBenchmarkTlsSettings(b, certPEM)
+	tls_settings.Config.ClientSessionCache = nil
+
+	for b.Loop() {
+		if result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings); !result.Decision {
+			b.Fatal("validation failed")
+		}
+	}
+}
+
+func BenchmarkCredentialsValidInImap(b *testing.B) {
+	port, certPEM, stop := startTestIMAPServer(b)
+	defer stop()
+	tls_settings := createBenchmarkTlsSettings(b, certPEM)
+
+	for b.Loop() {
+		if result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings); !result.Decision {
+			b.Fatal("validation failed")
+		}
+	}
+}
+
+func BenchmarkImapConnectionPool(b *testing.B) {
+	port, certPEM, stop := startTestIMAPServer(b)
+	defer stop()
+	tls_settings := createBenchmarkTlsSettings(b, certPEM)
+	key := poolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+	pool := createImapConnectionPool(1, time.Minute)
+	defer pool.Close()
+	pool.refill(key, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings)
+
+	for b.Loop() {
+		// measures the latency of a login between two storms
+		b.StopTimer()
+		waitForIdleConnections(b, pool, key, 1)
+		b.StartTimer()
+		if result := pool.validate(context.Background(), "127.0.0.1", port, "username", "password", tls_settings); !result.Decision {
+			b.Fatal("validation failed")
+		}
+	}
+}
+
+func BenchmarkImapConnectionPoolParallel(b *testing.B) {
+	port, certPEM, stop := startTestIMAPServer(b)
+	defer stop()
+	tls_settings := createBenchmarkTlsSettings(b, certPEM)
+	pool := createImapConnectionPool(8, time.Minute)
+	defer pool.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if result := pool.validate(context.Background(), "127.0.0.1", port, "username", "password", tls_settings); !result.Decision {
+				b.Error("validation failed")
+			}
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// connect via TLS (port 993)
+	IMAP_TLS_IMPLICIT = "implicit"
+	// connect in plain text and upgrade via STARTTLS (port 143)
+	IMAP_TLS_STARTTLS = "starttls"
+	// connect in plain text, only allowed to loopback and private addresses
+	IMAP_TLS_NONE = "none"
+)
+
+const IMAP_TLS_SESSION_CACHE_SIZE = 64
+
+// ImapTlsSettings describes how connections to an IMAP upstream are secured.
+// An empty Mode means implicit TLS. Config is built once on startup and is nil
+// for IMAP_TLS_NONE. ConnectTimeout limits connecting including the TLS
+// handshake, LoginTimeout limits the login. Zero means no timeout.
+type ImapTlsSettings struct {
+	Mode           string
+	Config         *tls.Config
+	ConnectTimeout time.Duration
+	LoginTimeout   time.Duration
+}
+
+// createImapTlsSettings builds the TLS configuration, so that unreadable files
+// are reported on startup instead of looking like an unreachable upstream. The
+// CA certificates of ca_cert_file (system roots if empty) and the extra CA
+// files are trusted. Pins are base64 encoded SHA-256 hashes of subject public
+// key infos, one of which has to be part of the certificate chain of the
+// upstream in addition to the regular verification.
+func createImapTlsSettings(ca_cert_file string, cfg ImapTlsConfiguration) (ImapTlsSettings, error) {
+	switch cfg.ImapTls {
+	case "", IMAP_TLS_IMPLICIT, IMAP_TLS_STARTTLS:
+	case IMAP_TLS_NONE:
+		return ImapTlsSettings{Mode: IMAP_TLS_NONE, ConnectTimeout: cfg.ImapConnectTimeout, LoginTimeout: cfg.ImapLoginTimeout}, nil
+	default:
+		return ImapTlsSettings{}, fmt.Errorf("unsupported imap tls mode %q", cfg.ImapTls)
+	}
+
+	version, err := parseTlsVersion(cfg.ImapTlsMinVersion)
+	if err != nil {
+		return ImapTlsSettings{}, err
+	}
+
+	for _, pin := range cfg.ImapTlsPins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return ImapTlsSettings{}, fmt.Errorf("pin %q is no base64 encoded SHA-256 hash", pin)
+		}
+	}
+
+	root_cas, err := loadCaCertificates(ca_cert_file, cfg.ImapTlsExtraCaFiles)
+	if err != nil {
+		return ImapTlsSettings{}, err
+	}
+
+	tls_config := &tls.Config{
+		RootCAs:    root_cas,
+		ServerName: cfg.ImapTlsServerName,
+		MinVersion: version,
+		// resumed sessions skip the certificate exchange of later connections
+		ClientSessionCache: tls.NewLRUClientSessionCache(IMAP_TLS_SESSION_CACHE_SIZE),
+	}
+	if len(cfg.ImapTlsPins) > 0 {
+		tls_config.VerifyConnection = verifyPinnedKey(cfg.ImapTlsPins)
+	}
+	if cfg.ImapTlsClientCertFile != "" || cfg.ImapTlsClientKeyFile != "" {
+		client_cert, err := tls.LoadX509KeyPair(cfg.ImapTlsClientCertFile, cfg.ImapTlsClientKeyFile)
+		if err != nil {
+			return ImapTlsSettings{}, fmt.Errorf("loading client certificate failed: %w", err)
+		}
+		tls_config.Certificates = []tls.Certificate{client_cert}
+	}
+
+	return ImapTlsSettings{
+		Mode:           cfg.ImapTls,
+		Config:         tls_config,
+		ConnectTimeout: cfg.ImapConnectTimeout,
+		LoginTimeout:   cfg.ImapLoginTimeout,
+	}, nil
+}
+
+func loadCaCertificates(ca_cert_file string, extra_ca_files []string) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	if ca_cert_file == "" {
+		system_pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("loading system CA certificates failed: %w", err)
+		}
+		pool = system_pool
+	} else {
+		pool = x509.NewCertPool()
+		extra_ca_files = append([]string{ca_cert_file}, extra_ca_files...)
+	}
+
+	for _, file := range extra_ca_files {
+		ca_cert, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates from %v failed: %w", file, err)
+		}
+		if !pool.AppendCertsFromPEM(ca_cert) {
+			return nil, fmt.Errorf("no certificates found in %v", file)
+		}
+	}
+	return pool, nil
+}
+
+func parseTlsVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q", version)
+}
+
+// verifyPinnedKey requires a pinned key in a verified chain. The certificates
+// sent by the server must not be used, as anyone can append the public pinned
+// certificate to a chain that verifies otherwise.
+func verifyPinnedKey(pins []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				encoded_hash := base64.StdEncoding.EncodeToString(hash[:])
+				for _, pin := range pins {
+					if subtle.ConstantTimeCompare([]byte(pin), []byte(encoded_hash)) == 1 {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("no certificate matches the pinned keys")
+	}
+}
+
+// privateNetworkDialer refuses connections to public addresses, so that
+// credentials are never sent in plain text over the internet. The address is
+// checked after resolution, so hostnames cannot circumvent the check.
+func privateNetworkDialer() *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !(ip.IsLoopback() || ip.IsPrivate()) {
+				return fmt.Errorf("refusing plain text connection to public address %v", host)
+			}
+			return nil
+		},
+	}
+}
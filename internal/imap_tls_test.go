@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+// startPlainTestIMAPServer starts an embedded IMAP server without TLS, which
+// supports STARTTLS and allows logins in plain text.
+func startPlainTestIMAPServer(t *testing.T) (int, []byte, func()) {
+	certPEM, keyPEM, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	asserts.AssertNil(t, err)
+
+	s := server.New(memory.New())
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+	s.AllowInsecureAuth = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	asserts.AssertNil(t, err)
+	go func() {
+		if err := s.Serve(listener); err != nil {
+			log.Printf("IMAP server error: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	return listener.Addr().(*net.TCPAddr).Port, certPEM, func() {
+		s.Close()
+		listener.Close()
+	}
+}
+
+func writeCaCertFile(t *testing.T, certPEM []byte) string {
+	ca_cert_file := t.TempDir() + "/ca.crt"
+	asserts.AssertNil(t, os.WriteFile(ca_cert_file, certPEM, 0644))
+	return ca_cert_file
+}
+
+func spkiPin(t *testing.T, certPEM []byte) string {
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	asserts.AssertNil(t, err)
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func createTestTlsSettings(t *testing.T, ca_cert_file string, cfg ImapTlsConfiguration) ImapTlsSettings {
+	tls_settings, err := createImapTlsSettings(ca_cert_file, cfg)
+	asserts.AssertNil(t, err)
+	return tls_settings
+}
+
+func TestCredentialsValidInImapViaStartTls(t *testing.T) {
+	port, certPEM, stop := startPlainTestIMAPServer(t)
+	defer stop()
+
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{ImapTls: IMAP_TLS_STARTTLS})
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "wrongpass", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestCredentialsValidInImapViaStartTlsWithUntrustedCert(t *testing.T) {
+	port, _, stop := startPlainTestIMAPServer(t)
+	defer stop()
+
+	otherCertPEM, _, err := generateSelfSignedCert("otherhost")
+	asserts.AssertNil(t, err)
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, otherCertPEM), ImapTlsConfiguration{ImapTls: IMAP_TLS_STARTTLS})
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestCredentialsValidInImapInPlainText(t *testing.T) {
+	port, _, stop := startPlainTestIMAPServer(t)
+	defer stop()
+
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", ImapTlsSettings{Mode: IMAP_TLS_NONE})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestPlainTextRefusedToPublicAddress(t *testing.T) {
+	dialer := privateNetworkDialer()
+	dialer.Timeout = time.Second
+	_, err := dialer.Dial("tcp", "192.0.2.1:143")
+	asserts.AssertNonNil(t, err)
+
+	result := credentialsValidInImap(context.Background(), "192.0.2.1", 143, "username", "password", ImapTlsSettings{Mode: IMAP_TLS_NONE})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestCredentialsValidInImapWithPinnedKey(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	otherCertPEM, _, err := generateSelfSignedCert("otherhost")
+	asserts.AssertNil(t, err)
+	ca_cert_file := writeCaCertFile(t, certPEM)
+
+	tls_settings := createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{ImapTlsPins: []string{spkiPin(t, otherCertPEM), spkiPin(t, certPEM)}})
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	// resumed sessions are checked as well
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	tls_settings = createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{ImapTlsPins: []string{spkiPin(t, otherCertPEM)}})
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestPinnedKeyAppendedToChainIsRefused(t *testing.T) {
+	certPEM, keyPEM, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	asserts.AssertNil(t, err)
+	pinnedCertPEM, _, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	pinnedBlock, _ := pem.Decode(pinnedCertPEM)
+
+	// the server sends a trusted chain plus the unrelated pinned certificate
+	tlsCert.Certificate = append(tlsCert.Certificate, pinnedBlock.Bytes)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	asserts.AssertNil(t, err)
+	defer listener.Close()
+	s := server.New(memory.New())
+	go s.Serve(listener)
+	defer s.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{ImapTlsPins: []string{spkiPin(t, pinnedCertPEM)}})
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+
+	tls_settings = createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{ImapTlsPins: []string{spkiPin(t, certPEM)}})
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestImapTlsSessionResumption(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	tls_settings := createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{})
+	asserts.AssertNonNil(t, tls_settings.Config.ClientSessionCache)
+
+	connect := func() bool {
+		conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), tls_settings.Config)
+		asserts.AssertNil(t, err)
+		defer conn.Close()
+		// session tickets of TLS 1.3 arrive with the greeting
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		asserts.AssertNil(t, err)
+		return conn.ConnectionState().DidResume
+	}
+	asserts.AssertEquals(t, false, connect())
+	asserts.AssertEquals(t, true, connect())
+}
+
+func TestCredentialsValidInImapWithServerName(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	ca_cert_file := writeCaCertFile(t, certPEM)
+
+	// the certificate is issued for localhost
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{ImapTlsServerName: "localhost"}))
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{ImapTlsServerName: "otherhost"}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestCreateImapTlsSettings(t *testing.T) {
+	certPEM, _, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	ca_cert_file := writeCaCertFile(t, certPEM)
+
+	tls_settings, err := createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{
+		ImapTls:           IMAP_TLS_STARTTLS,
+		ImapTlsServerName: "imap.example.org",
+		ImapTlsMinVersion: "1.3",
+		ImapTlsPins:       []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	})
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, IMAP_TLS_STARTTLS, tls_settings.Mode)
+	asserts.AssertEquals(t, uint16(tls.VersionTLS13), tls_settings.Config.MinVersion)
+	asserts.AssertEquals(t, "imap.example.org", tls_settings.Config.ServerName)
+	asserts.AssertNonNil(t, tls_settings.Config.VerifyConnection)
+
+	tls_settings, err = createImapTlsSettings("/missing/ca.crt", ImapTlsConfiguration{ImapTls: IMAP_TLS_NONE})
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, true, tls_settings.Config == nil)
+
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTls: "ssl"})
+	asserts.AssertNonNil(t, err)
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTlsMinVersion: "1.4"})
+	asserts.AssertNonNil(t, err)
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTlsPins: []string{"not a hash"}})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestCreateImapTlsSettingsWithUnreadableFiles(t *testing.T) {
+	certPEM, keyPEM, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	ca_cert_file := writeCaCertFile(t, certPEM)
+	no_cert_file := t.TempDir() + "/empty.crt"
+	asserts.AssertNil(t, os.WriteFile(no_cert_file, []byte("no certificate"), 0644))
+	key_file := t.TempDir() + "/client.key"
+	asserts.AssertNil(t, os.WriteFile(key_file, keyPEM, 0600))
+
+	_, err = createImapTlsSettings("/missing/ca.crt", ImapTlsConfiguration{})
+	asserts.AssertNonNil(t, err)
+	asserts.AssertEquals(t, true, strings.Contains(err.Error(), "/missing/ca.crt"))
+
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTlsExtraCaFiles: []string{no_cert_file}})
+	asserts.AssertNonNil(t, err)
+	asserts.AssertEquals(t, true, strings.Contains(err.Error(), no_cert_file))
+
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTlsClientCertFile: "/missing/client.crt", ImapTlsClientKeyFile: key_file})
+	asserts.AssertNonNil(t, err)
+	_, err = createImapTlsSettings(ca_cert_file, ImapTlsConfiguration{ImapTlsClientCertFile: ca_cert_file})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestCredentialsValidInImapWithExtraCaFile(t *testing.T) {
+	port, certPEM, stop := startTestIMAPServer(t)
+	defer stop()
+	otherCertPEM, _, err := generateSelfSignedCert("otherhost")
+	asserts.AssertNil(t, err)
+
+	// the system roots do not trust the self-signed certificate
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, "", ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+
+	tls_settings := createTestTlsSettings(t, "", ImapTlsConfiguration{ImapTlsExtraCaFiles: []string{writeCaCertFile(t, certPEM)}})
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+
+	// extra CA files add to the configured CA certificates
+	tls_settings = createTestTlsSettings(t, writeCaCertFile(t, otherCertPEM), ImapTlsConfiguration{ImapTlsExtraCaFiles: []string{writeCaCertFile(t, certPEM)}})
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestCredentialsValidInImapWithClientCertificate(t *testing.T) {
+	serverCertPEM, serverKeyPEM, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	asserts.AssertNil(t, err)
+	clientCertPEM, clientKeyPEM, err := generateSelfSignedCert("client")
+	asserts.AssertNil(t, err)
+	client_cas := x509.NewCertPool()
+	client_cas.AppendCertsFromPEM(clientCertPEM)
+
+	s := server.New(memory.New())
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    client_cas,
+	})
+	asserts.AssertNil(t, err)
+	go s.Serve(listener)
+	defer s.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	ca_cert_file := writeCaCertFile(t, serverCertPEM)
+
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+
+	client_dir := t.TempDir()
+	asserts.AssertNil(t, os.WriteFile(client_dir+"/client.crt", clientCertPEM, 0644))
+	asserts.AssertNil(t, os.WriteFile(client_dir+"/client.key", clientKeyPEM, 0600))
+	tls_settings := createTestTlsSettings(t, ca_cert_file, ImapTlsConfiguration{
+		ImapTlsClientCertFile: client_dir + "/client.crt",
+		ImapTlsClientKeyFile:  client_dir + "/client.key",
+	})
+	result = credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", tls_settings)
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestImapTlsMinVersion(t *testing.T) {
+	certPEM, keyPEM, err := generateSelfSignedCert("localhost")
+	asserts.AssertNil(t, err)
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	asserts.AssertNil(t, err)
+
+	s := server.New(memory.New())
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{tlsCert}, MaxVersion: tls.VersionTLS12})
+	asserts.AssertNil(t, err)
+	go s.Serve(listener)
+	defer s.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	result := credentialsValidInImap(context.Background(), "127.0.0.1", port, "username", "password", createTestTlsSettings(t, writeCaCertFile(t, certPEM), ImapTlsConfiguration{ImapTlsMinVersion: "1.3"}))
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
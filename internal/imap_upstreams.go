@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// use the first healthy upstream in configuration order
+	UPSTREAM_STRATEGY_FAILOVER = "failover"
+	// rotate through the healthy upstreams
+	UPSTREAM_STRATEGY_ROUND_ROBIN = "round_robin"
+	// use the healthy upstream with the fewest running validations
+	UPSTREAM_STRATEGY_LEAST_CONNECTIONS = "least_connections"
+
+	HEALTH_CHECK_TIMEOUT = 5 * time.Second
+)
+
+type imapUpstream struct {
+	host        string
+	port        int
+	healthy     atomic.Bool
+	connections atomic.Int64
+}
+
+func (upstream *imapUpstream) address() string {
+	return net.JoinHostPort(upstream.host, strconv.Itoa(upstream.port))
+}
+
+// imapUpstreamPool selects the IMAP upstream used for validation and returned
+// to nginx. Upstreams are considered unhealthy if they cannot be reached by the
+// periodic health check or by a validation, and healthy again as soon as they
+// can be reached.
+type imapUpstreamPool struct {
+	upstreams []*imapUpstream
+	strategy  string
+	next      atomic.Uint64
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// imapUpstreamPools shares the pools and upstreams between the routes. Routes
+// with the same upstreams use the same pool, so every upstream is only checked
+// and reported once.
+type imapUpstreamPools struct {
+	pools     map[string]*imapUpstreamPool
+	upstreams map[string]*imapUpstream
+	metrics   *Metrics
+}
+
+func createImapUpstreamPools(metrics *Metrics) *imapUpstreamPools {
+	return &imapUpstreamPools{
+		pools:     make(map[string]*imapUpstreamPool),
+		upstreams: make(map[string]*imapUpstream),
+		metrics:   metrics,
+	}
+}
+
+// get returns the pool of the upstreams of the configuration and creates it on
+// first use.
+func (pools *imapUpstreamPools) get(cfg Configuration) (*imapUpstreamPool, error) {
+	strategy := cfg.ImapUpstreamStrategy
+	switch strategy {
+	case "":
+		strategy = UPSTREAM_STRATEGY_FAILOVER
+	case UPSTREAM_STRATEGY_FAILOVER, UPSTREAM_STRATEGY_ROUND_ROBIN, UPSTREAM_STRATEGY_LEAST_CONNECTIONS:
+	default:
+		return nil, fmt.Errorf("unsupported upstream strategy %q", strategy)
+	}
+
+	// a single imap_host is the only upstream
+	upstream_cfgs := cfg.ImapUpstreams
+	if len(upstream_cfgs) == 0 {
+		upstream_cfgs = []ImapUpstreamConfiguration{{Host: cfg.ImapServer, Port: cfg.ImapPort}}
+	}
+
+	upstreams := make([]*imapUpstream, 0, len(upstream_cfgs))
+	addresses := make([]string, 0, len(upstream_cfgs))
+	for _, upstream_cfg := range upstream_cfgs {
+		upstream := pools.upstream(upstream_cfg.Host, upstream_cfg.Port)
+		upstreams = append(upstreams, upstream)
+		addresses = append(addresses, upstream.address())
+	}
+
+	key := strategy + " " + strings.Join(addresses, " ")
+	if pool, found := pools.pools[key]; found {
+		return pool, nil
+	}
+	pool := &imapUpstreamPool{upstreams: upstreams, strategy: strategy}
+	pools.pools[key] = pool
+	return pool, nil
+}
+
+// upstream returns the upstream of the address, so pools with different
+// strategies share the health of the upstream.
+func (pools *imapUpstreamPools) upstream(host string, port int) *imapUpstream {
+	if port == 0 {
+		port = 993
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if upstream, found := pools.upstreams[address]; found {
+		return upstream
+	}
+
+	upstream := &imapUpstream{host: host, port: port}
+	upstream.healthy.Store(true)
+	pools.upstreams[address] = upstream
+
+	pools.metrics.Gauge(fmt.Sprintf(`imap_upstream_healthy{upstream=%q}`, address), "Whether the IMAP upstream is healthy.", func() float64 {
+		if upstream.healthy.Load() {
+			return 1
+		}
+		return 0
+	})
+	return upstream
+}
+
+// candidates returns the upstreams in the order they should be tried. Healthy
+// upstreams come first in the order of the strategy, unhealthy upstreams are
+// only tried as last resort.
+func (pool *imapUpstreamPool) candidates() []*imapUpstream {
+	var healthy, unhealthy []*imapUpstream
+	for _, upstream := range pool.upstreams {
+		if upstream.healthy.Load() {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+
+	switch pool.strategy {
+	case UPSTREAM_STRATEGY_ROUND_ROBIN:
+		if len(healthy) > 1 {
+			offset := int(pool.next.Add(1)-1) % len(healthy)
+			healthy = slices.Concat(healthy[offset:], healthy[:offset])
+		}
+	case UPSTREAM_STRATEGY_LEAST_CONNECTIONS:
+		slices.SortStableFunc(healthy, func(a, b *imapUpstream) int {
+			return int(a.connections.Load() - b.connections.Load())
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// selectUpstream returns the upstream nginx should connect to or nil if there
+// is none.
+func (pool *imapUpstreamPool) selectUpstream() *imapUpstream {
+	candidates := pool.candidates()
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0]
+}
+
+// startHealthChecks checks all upstreams every interval until Stop is called.
+// Pools shared by several routes are only checked once.
+func (pool *imapUpstreamPool) startHealthChecks(interval time.Duration, check func(upstream *imapUpstream) bool) {
+	if pool.stop != nil {
+		return
+	}
+	pool.stop = make(chan struct{})
+	pool.done = make(chan struct{})
+	go func() {
+		defer close(pool.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+				for _, upstream := range pool.upstreams {
+					upstream.healthy.Store(check(upstream))
+				}
+			}
+		}
+	}()
+}
+
+func (pool *imapUpstreamPool) Stop() {
+	if pool.stop != nil {
+		close(pool.stop)
+		<-pool.done
+		pool.stop = nil
+	}
+}
+
+// isImapUpstreamReachable only checks that the upstream accepts TCP connections,
+// the credentials are checked by the validations.
+func isImapUpstreamReachable(upstream *imapUpstream) bool {
+	conn, err := net.DialTimeout("tcp", upstream.address(), HEALTH_CHECK_TIMEOUT)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// createImapPoolBackend validates credentials at the upstreams of the pool. The
+// next candidate is only tried if an upstream could not decide.
+func createImapPoolBackend(imap_validator ImapValidator, pool *imapUpstreamPool, tls_settings ImapTlsSettings) CredentialsValidator {
+	return func(request ValidationRequest) ValidationResult {
+		timeout := false
+		for _, upstream := range pool.candidates() {
+			// nginx gave up, so the other candidates are not of interest anymore
+			if request.Context().Err() != nil {
+				return ValidationResult{Decision: false, Valid: false, Timeout: true}
+			}
+
+			upstream.connections.Add(1)
+			result := imap_validator(request.Context(), upstream.host, upstream.port, request.User, request.Pass, tls_settings)
+			upstream.connections.Add(-1)
+
+			upstream.healthy.Store(result.Valid)
+			if result.Valid {
+				// nginx connects to the upstream that validated the credentials
+				result.upstream = upstream
+				return result
+			}
+			timeout = timeout || result.Timeout
+		}
+		return ValidationResult{Decision: false, Valid: false, Timeout: timeout}
+	}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestSingleImapHostIsOnlyUpstream(t *testing.T) {
+	pool, err := createImapUpstreamPools(CreateMetrics()).get(Configuration{ImapServer: "imap.example.org"})
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, len(pool.upstreams))
+	asserts.AssertEquals(t, "imap.example.org:993", pool.selectUpstream().address())
+}
+
+func TestUnsupportedUpstreamStrategy(t *testing.T) {
+	_, err := createImapUpstreamPools(CreateMetrics()).get(Configuration{ImapUpstreamStrategy: "foo"})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestFailoverUpstreams(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_FAILOVER)
+	asserts.AssertStringArraysEquals(t, []string{"imap1", "imap2", "imap3"}, candidateHosts(pool))
+	asserts.AssertStringArraysEquals(t, []string{"imap1", "imap2", "imap3"}, candidateHosts(pool))
+
+	pool.upstreams[0].healthy.Store(false)
+	asserts.AssertStringArraysEquals(t, []string{"imap2", "imap3", "imap1"}, candidateHosts(pool))
+}
+
+func TestRoundRobinUpstreams(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_ROUND_ROBIN)
+	asserts.AssertStringArraysEquals(t, []string{"imap1", "imap2", "imap3"}, candidateHosts(pool))
+	asserts.AssertStringArraysEquals(t, []string{"imap2", "imap3", "imap1"}, candidateHosts(pool))
+	asserts.AssertStringArraysEquals(t, []string{"imap3", "imap1", "imap2"}, candidateHosts(pool))
+
+	pool.upstreams[1].healthy.Store(false)
+	asserts.AssertStringArraysEquals(t, []string{"imap3", "imap1", "imap2"}, candidateHosts(pool))
+	asserts.AssertStringArraysEquals(t, []string{"imap1", "imap3", "imap2"}, candidateHosts(pool))
+}
+
+func TestLeastConnectionsUpstreams(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_LEAST_CONNECTIONS)
+	pool.upstreams[0].connections.Store(2)
+	pool.upstreams[1].connections.Store(1)
+	asserts.AssertStringArraysEquals(t, []string{"imap3", "imap2", "imap1"}, candidateHosts(pool))
+
+	pool.upstreams[2].connections.Store(3)
+	asserts.AssertStringArraysEquals(t, []string{"imap2", "imap1", "imap3"}, candidateHosts(pool))
+}
+
+func TestImapPoolBackendFailsOver(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_FAILOVER)
+	var queried_hosts []string
+	backend := createImapPoolBackend(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		queried_hosts = append(queried_hosts, imap_host)
+		return ValidationResult{Decision: imap_host == "imap2", Valid: imap_host != "imap1"}
+	}, pool, ImapTlsSettings{})
+
+	result := backend(ValidationRequest{User: "test", Pass: "test"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertStringArraysEquals(t, []string{"imap1", "imap2"}, queried_hosts)
+
+	// the unreachable upstream is tried last from now on
+	asserts.AssertEquals(t, false, pool.upstreams[0].healthy.Load())
+	asserts.AssertEquals(t, "imap2", pool.selectUpstream().host)
+}
+
+func TestImapPoolBackendAllUnreachable(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_FAILOVER)
+	backend := createImapPoolBackend(func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: false, Valid: false}
+	}, pool, ImapTlsSettings{})
+
+	result := backend(ValidationRequest{User: "test", Pass: "test"})
+	asserts.AssertEquals(t, false, result.Valid)
+}
+
+func TestUpstreamHealthChecks(t *testing.T) {
+	pool := createTestUpstreamPool(t, UPSTREAM_STRATEGY_FAILOVER)
+	pool.startHealthChecks(10*time.Millisecond, func(upstream *imapUpstream) bool {
+		return upstream.host != "imap1"
+	})
+	time.Sleep(100 * time.Millisecond)
+	pool.Stop()
+
+	asserts.AssertEquals(t, false, pool.upstreams[0].healthy.Load())
+	asserts.AssertEquals(t, true, pool.upstreams[1].healthy.Load())
+}
+
+func TestImapUpstreamReachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	asserts.AssertNil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	asserts.AssertEquals(t, true, isImapUpstreamReachable(&imapUpstream{host: "127.0.0.1", port: port}))
+	listener.Close()
+	asserts.AssertEquals(t, false, isImapUpstreamReachable(&imapUpstream{host: "127.0.0.1", port: port}))
+}
+
+func TestImapResponseUsesSelectedUpstream(t *testing.T) {
+	var cfg Configuration
+	asserts.AssertNil(t, cfg.Load("testdata/config_upstreams.yaml"))
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		return ValidationResult{Decision: true, Valid: imap_host != "imap1.example.org"}
+	}, createFakeResolver(), time.Minute)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "some_user", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.11", response.Server)
+	asserts.AssertEquals(t, 1993, response.Port)
+}
+
+func TestRoundRobinResponseUsesValidatingUpstream(t *testing.T) {
+	cfg := Configuration{
+		WhitelistedUsers:     []string{"user1", "user2", "user3", "user4"},
+		ImapUpstreams:        []ImapUpstreamConfiguration{{Host: "imap.example.org"}, {Host: "imap2.example.org"}},
+		ImapUpstreamStrategy: UPSTREAM_STRATEGY_ROUND_ROBIN,
+	}
+	addresses := map[string]string{"imap.example.org": "192.0.2.10", "imap2.example.org": "192.0.2.11"}
+	var validated_at []string
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		validated_at = append(validated_at, addresses[imap_host])
+		return ValidationResult{Decision: true, Valid: true}
+	}, createFakeResolver(), time.Minute)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+
+	var servers []string
+	for _, user := range cfg.WhitelistedUsers {
+		response := handler.HandleAuthRequest(context.Background(), "imap", user, "test", "127.0.0.1", 1)
+		asserts.AssertEquals(t, "OK", response.Status)
+		servers = append(servers, response.Server)
+	}
+	asserts.AssertStringArraysEquals(t, []string{"192.0.2.10", "192.0.2.11", "192.0.2.10", "192.0.2.11"}, servers)
+	asserts.AssertStringArraysEquals(t, servers, validated_at)
+}
+
+func createTestUpstreamPool(t *testing.T, strategy string) *imapUpstreamPool {
+	cfg := Configuration{
+		ImapUpstreams: []ImapUpstreamConfiguration{
+			{Host: "imap1"}, {Host: "imap2"}, {Host: "imap3"},
+		},
+		ImapUpstreamStrategy: strategy,
+	}
+	pool, err := createImapUpstreamPools(CreateMetrics()).get(cfg)
+	asserts.AssertNil(t, err)
+	return pool
+}
+
+func candidateHosts(pool *imapUpstreamPool) []string {
+	var hosts []string
+	for _, upstream := range pool.candidates() {
+		hosts = append(hosts, upstream.host)
+	}
+	return hosts
+}
+
+func TestUpstreamHealthReportedOnce(t *testing.T) {
+	metrics := CreateMetrics()
+	pools := createImapUpstreamPools(metrics)
+	_, err := pools.get(Configuration{ImapUpstreams: []ImapUpstreamConfiguration{{Host: "imap1"}, {Host: "imap2"}}})
+	asserts.AssertNil(t, err)
+	pool, err := pools.get(Configuration{ImapUpstreams: []ImapUpstreamConfiguration{{Host: "imap2", Port: 993}}, ImapUpstreamStrategy: UPSTREAM_STRATEGY_ROUND_ROBIN})
+	asserts.AssertNil(t, err)
+	pool.upstreams[0].healthy.Store(false)
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP nginxmailauthdelegator_imap_upstream_healthy Whether the IMAP upstream is healthy.
+# TYPE nginxmailauthdelegator_imap_upstream_healthy gauge
+nginxmailauthdelegator_imap_upstream_healthy{upstream="imap1:993"} 1
+nginxmailauthdelegator_imap_upstream_healthy{upstream="imap2:993"} 0
+`
+	asserts.AssertEquals(t, expected, w.Body.String())
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const METRICS_PREFIX = "nginxmailauthdelegator_"
+
+// Metrics collects counters and gauges and exposes them in the text format of
+// Prometheus. Names may contain labels, e.g. cache_evictions_total{reason="expired"}.
+type Metrics struct {
+	mutex    sync.Mutex
+	help     map[string]string
+	types    map[string]string
+	counters map[string]*atomic.Uint64
+	gauges   map[string]func() float64
+}
+
+func CreateMetrics() *Metrics {
+	return &Metrics{
+		help:     make(map[string]string),
+		types:    make(map[string]string),
+		counters: make(map[string]*atomic.Uint64),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// Counter returns the counter of the given name and creates it if required.
+func (metrics *Metrics) Counter(name, help string) *atomic.Uint64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.describe(name, "counter", help)
+	counter, found := metrics.counters[name]
+	if !found {
+		counter = &atomic.Uint64{}
+		metrics.counters[name] = counter
+	}
+	return counter
+}
+
+// Gauge registers a function that determines the value of the gauge on every
+// scrape. Registering a gauge again replaces the function.
+func (metrics *Metrics) Gauge(name, help string, value func() float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.describe(name, "gauge", help)
+	metrics.gauges[name] = value
+}
+
+// describe has to be called while holding the mutex
+func (metrics *Metrics) describe(name, metric_type, help string) {
+	base_name, _, _ := strings.Cut(name, "{")
+	metrics.help[base_name] = help
+	metrics.types[base_name] = metric_type
+}
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics.mutex.Lock()
+	values := make(map[string]string)
+	for name, counter := range metrics.counters {
+		values[name] = fmt.Sprint(counter.Load())
+	}
+	for name, gauge := range metrics.gauges {
+		values[name] = fmt.Sprint(gauge())
+	}
+	help := maps.Clone(metrics.help)
+	types := maps.Clone(metrics.types)
+	metrics.mutex.Unlock()
+
+	names := slices.Sorted(maps.Keys(values))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	described := make(map[string]bool)
+	for _, name := range names {
+		base_name, _, _ := strings.Cut(name, "{")
+		if !described[base_name] {
+			fmt.Fprintf(w, "# HELP %s%s %s\n", METRICS_PREFIX, base_name, help[base_name])
+			fmt.Fprintf(w, "# TYPE %s%s %s\n", METRICS_PREFIX, base_name, types[base_name])
+			described[base_name] = true
+		}
+		fmt.Fprintf(w, "%s%s %s\n", METRICS_PREFIX, name, values[name])
+	}
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	metrics := CreateMetrics()
+	metrics.Counter(`evictions_total{reason="expired"}`, "Evicted entries.").Add(2)
+	metrics.Counter(`evictions_total{reason="capacity"}`, "Evicted entries.").Add(1)
+	metrics.Gauge("entries", "Current entries.", func() float64 { return 3 })
+
+	// counters are shared by name
+	metrics.Counter(`evictions_total{reason="expired"}`, "Evicted entries.").Add(1)
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP nginxmailauthdelegator_entries Current entries.
+# TYPE nginxmailauthdelegator_entries gauge
+nginxmailauthdelegator_entries 3
+# HELP nginxmailauthdelegator_evictions_total Evicted entries.
+# TYPE nginxmailauthdelegator_evictions_total counter
+nginxmailauthdelegator_evictions_total{reason="capacity"} 1
+nginxmailauthdelegator_evictions_total{reason="expired"} 3
+`
+	asserts.AssertEquals(t, expected, w.Body.String())
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/md5_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// verifyPasswordHash checks a password against a stored hash. The hash may carry
+// a Dovecot style scheme prefix like {SHA512-CRYPT}. Without a prefix, the scheme
+// is derived from the crypt(3) or PHC format of the hash.
+func verifyPasswordHash(hash string, pass []byte) (bool, error) {
+	scheme, hash := splitPasswordScheme(hash)
+	if scheme == "" || scheme == "CRYPT" {
+		scheme = detectPasswordScheme(hash)
+	}
+
+	switch scheme {
+	case "BLF-CRYPT":
+		return bcrypt.CompareHashAndPassword([]byte(hash), pass) == nil, nil
+	case "SHA512-CRYPT", "SHA256-CRYPT", "MD5-CRYPT":
+		if !crypt.IsHashSupported(hash) {
+			return false, fmt.Errorf("malformed %v hash", scheme)
+		}
+		return crypt.NewFromHash(hash).Verify(hash, pass) == nil, nil
+	case "ARGON2ID", "ARGON2I":
+		return verifyArgon2Hash(hash, pass)
+	case "PLAIN", "CLEARTEXT":
+		return subtle.ConstantTimeCompare([]byte(hash), pass) == 1, nil
+	}
+	return false, fmt.Errorf("unsupported password scheme %q", scheme)
+}
+
+func splitPasswordScheme(hash string) (string, string) {
+	if !strings.HasPrefix(hash, "{") {
+		return "", hash
+	}
+	end := strings.Index(hash, "}")
+	if end < 0 {
+		return "", hash
+	}
+	return strings.ToUpper(hash[1:end]), hash[end+1:]
+}
+
+func detectPasswordScheme(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return "BLF-CRYPT"
+	case strings.HasPrefix(hash, "$6$"):
+		return "SHA512-CRYPT"
+	case strings.HasPrefix(hash, "$5$"):
+		return "SHA256-CRYPT"
+	case strings.HasPrefix(hash, "$1$"):
+		return "MD5-CRYPT"
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return "ARGON2ID"
+	case strings.HasPrefix(hash, "$argon2i$"):
+		return "ARGON2I"
+	}
+	return ""
+}
+
+// limits of the argon2 parameters of stored hashes, which are computed on the
+// request path (memory in KiB)
+const (
+	ARGON2_MAX_MEMORY = 256 * 1024
+	ARGON2_MAX_TIME   = 16
+)
+
+// verifyArgon2Hash checks a password against a hash in PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=1$<salt>$<hash>
+func verifyArgon2Hash(hash string, pass []byte) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2 hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2 parameters %q", parts[3])
+	}
+	if time < 1 || threads < 1 || memory > ARGON2_MAX_MEMORY || time > ARGON2_MAX_TIME {
+		return false, fmt.Errorf("argon2 parameters %q out of range", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 salt: %w", err)
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2 hash: %w", err)
+	}
+	// an empty hash would match every password
+	if len(expected) == 0 {
+		return false, fmt.Errorf("malformed argon2 hash: empty")
+	}
+
+	var actual []byte
+	switch parts[1] {
+	case "argon2id":
+		actual = argon2.IDKey(pass, salt, time, memory, threads, uint32(len(expected)))
+	case "argon2i":
+		actual = argon2.Key(pass, salt, time, memory, threads, uint32(len(expected)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare(expected, actual) == 1, nil
+}
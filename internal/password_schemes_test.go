@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/GehirnInc/crypt"
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyBcryptHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	asserts.AssertNil(t, err)
+
+	assertPasswordHashMatches(t, string(hash), "secret", true)
+	assertPasswordHashMatches(t, "{BLF-CRYPT}"+string(hash), "secret", true)
+	assertPasswordHashMatches(t, "{BLF-CRYPT}"+string(hash), "wrong", false)
+}
+
+func TestVerifyShaCryptHash(t *testing.T) {
+	hash, err := crypt.SHA512.New().Generate([]byte("secret"), []byte("$6$saltsalt"))
+	asserts.AssertNil(t, err)
+
+	assertPasswordHashMatches(t, hash, "secret", true)
+	assertPasswordHashMatches(t, "{SHA512-CRYPT}"+hash, "secret", true)
+	assertPasswordHashMatches(t, "{CRYPT}"+hash, "secret", true)
+	assertPasswordHashMatches(t, "{SHA512-CRYPT}"+hash, "wrong", false)
+
+	hash, err = crypt.SHA256.New().Generate([]byte("secret"), []byte("$5$saltsalt"))
+	asserts.AssertNil(t, err)
+	assertPasswordHashMatches(t, "{SHA256-CRYPT}"+hash, "secret", true)
+}
+
+func TestVerifyArgon2idHash(t *testing.T) {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	assertPasswordHashMatches(t, hash, "secret", true)
+	assertPasswordHashMatches(t, "{ARGON2ID}"+hash, "secret", true)
+	assertPasswordHashMatches(t, "{ARGON2ID}"+hash, "wrong", false)
+}
+
+func TestVerifyArgon2HashWithMalformedParameters(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("somesaltsomesalt"))
+	key := base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), []byte("somesaltsomesalt"), 1, 1024, 1, 32))
+
+	for _, hash := range []string{
+		fmt.Sprintf("{ARGON2ID}$argon2id$v=%d$m=65536,t=0,p=1$%s$%s", argon2.Version, salt, key),
+		fmt.Sprintf("{ARGON2ID}$argon2id$v=%d$m=65536,t=1,p=0$%s$%s", argon2.Version, salt, key),
+		fmt.Sprintf("{ARGON2ID}$argon2id$v=%d$m=4294967295,t=1,p=1$%s$%s", argon2.Version, salt, key),
+		fmt.Sprintf("{ARGON2ID}$argon2id$v=%d$m=1024,t=4294967295,p=1$%s$%s", argon2.Version, salt, key),
+		fmt.Sprintf("{ARGON2I}$argon2i$v=%d$m=1024,t=0,p=1$%s$%s", argon2.Version, salt, key),
+		fmt.Sprintf("{ARGON2ID}$argon2id$v=%d$m=1024,t=1,p=1$%s$", argon2.Version, salt),
+	} {
+		match, err := verifyPasswordHash(hash, []byte("secret"))
+		asserts.AssertNonNil(t, err)
+		asserts.AssertEquals(t, false, match)
+	}
+}
+
+func TestVerifyPlainHash(t *testing.T) {
+	assertPasswordHashMatches(t, "{PLAIN}secret", "secret", true)
+	assertPasswordHashMatches(t, "{PLAIN}secret", "wrong", false)
+}
+
+func TestVerifyUnsupportedHash(t *testing.T) {
+	_, err := verifyPasswordHash("{FOO}secret", []byte("secret"))
+	asserts.AssertNonNil(t, err)
+	_, err = verifyPasswordHash("secret", []byte("secret"))
+	asserts.AssertNonNil(t, err)
+	_, err = verifyPasswordHash("$argon2id$broken", []byte("secret"))
+	asserts.AssertNonNil(t, err)
+}
+
+func assertPasswordHashMatches(t *testing.T, hash, pass string, expected bool) {
+	match, err := verifyPasswordHash(hash, []byte(pass))
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, expected, match)
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+const (
+	// resend requests as UDP packets may get lost
+	RADIUS_RETRY_INTERVAL = time.Second
+	RADIUS_NAS_IDENTIFIER = "nginx-mail-auth-delegator"
+)
+
+// createRadiusBackend validates credentials via PAP Access-Requests. The servers
+// are queried in order until one of them answers within the timeout. The timeout
+// should allow for MFA push confirmations.
+func createRadiusBackend(servers []string, secret string, timeout time.Duration) CredentialsValidator {
+	client := &radius.Client{
+		Retry: RADIUS_RETRY_INTERVAL,
+	}
+
+	return func(request ValidationRequest) ValidationResult {
+		packet := radius.New(radius.CodeAccessRequest, []byte(secret))
+		if rfc2865.UserName_SetString(packet, request.User) != nil ||
+			rfc2865.UserPassword_SetString(packet, request.Pass) != nil ||
+			rfc2865.NASIdentifier_SetString(packet, RADIUS_NAS_IDENTIFIER) != nil {
+			return ValidationResult{Decision: false, Valid: false}
+		}
+
+		for _, server := range servers {
+			ctx, cancel := context.WithTimeout(request.Context(), timeout)
+			response, err := client.Exchange(ctx, packet, server)
+			cancel()
+			if err != nil {
+				log.Printf("querying radius server %v failed: %v", server, err)
+				continue
+			}
+
+			// challenges cannot be answered, so they count as rejection
+			return ValidationResult{Decision: response.Code == radius.CodeAccessAccept, Valid: true}
+		}
+
+		return ValidationResult{Decision: false, Valid: false}
+	}
+}
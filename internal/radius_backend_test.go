@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// startTestRadiusServer starts a RADIUS server on a random UDP port
+// Returns the address and a function to stop the server
+// The server accepts "username"/"password" and rejects all other credentials
+func startTestRadiusServer(t *testing.T, secret string) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	asserts.AssertNil(t, err)
+
+	server := radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte(secret)),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			code := radius.CodeAccessReject
+			if rfc2865.UserName_GetString(r.Packet) == "username" && rfc2865.UserPassword_GetString(r.Packet) == "password" {
+				code = radius.CodeAccessAccept
+			}
+			w.Write(r.Response(code))
+		}),
+	}
+	go server.Serve(conn)
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+	}
+}
+
+func TestRadiusBackendValidCredentials(t *testing.T) {
+	address, stop := startTestRadiusServer(t, "secret")
+	defer stop()
+
+	result := createRadiusBackend([]string{address}, "secret", time.Second)(ValidationRequest{User: "username", Pass: "password"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestRadiusBackendInvalidCredentials(t *testing.T) {
+	address, stop := startTestRadiusServer(t, "secret")
+	defer stop()
+
+	result := createRadiusBackend([]string{address}, "secret", time.Second)(ValidationRequest{User: "username", Pass: "wrongpass"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestRadiusBackendWrongSecret(t *testing.T) {
+	address, stop := startTestRadiusServer(t, "secret")
+	defer stop()
+
+	// the server drops requests with a wrong secret
+	result := createRadiusBackend([]string{address}, "wrongsecret", 500*time.Millisecond)(ValidationRequest{User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestRadiusBackendFailoverToSecondServer(t *testing.T) {
+	address, stop := startTestRadiusServer(t, "secret")
+	defer stop()
+	unavailable_address, stop_unavailable := startTestRadiusServer(t, "secret")
+	stop_unavailable()
+
+	result := createRadiusBackend([]string{unavailable_address, address}, "secret", 500*time.Millisecond)(ValidationRequest{User: "username", Pass: "password"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
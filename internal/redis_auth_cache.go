@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is asked on the request path, so an unavailable Redis must not delay
+// logins for long. Failures count as cache miss.
+const (
+	REDIS_TIMEOUT      = 500 * time.Millisecond
+	REDIS_LIST_TIMEOUT = 10 * time.Second
+	REDIS_MAX_RETRIES  = 1
+)
+
+// redisAuthCache stores every entry as Redis hash that expires together with
+// the entry (plus the stale grace period), so that several instances can share
+// their cache.
+type redisAuthCache struct {
+	client      *redis.Client
+	key_prefix  string
+	stale_grace time.Duration
+}
+
+func createRedisAuthCache(address, password string, db int, key_prefix string, stale_grace time.Duration) *redisAuthCache {
+	return &redisAuthCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:         address,
+			Password:     password,
+			DB:           db,
+			DialTimeout:  REDIS_TIMEOUT,
+			ReadTimeout:  REDIS_TIMEOUT,
+			WriteTimeout: REDIS_TIMEOUT,
+			MaxRetries:   REDIS_MAX_RETRIES,
+			// the client tries to dial five times by default
+			DialerRetries: 1,
+		}),
+		key_prefix:  key_prefix,
+		stale_grace: stale_grace,
+	}
+}
+
+func (cache *redisAuthCache) get(key string) (authCacheEntry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_TIMEOUT)
+	defer cancel()
+	fields, err := cache.client.HGetAll(ctx, cache.key_prefix+key).Result()
+	if err != nil {
+		log.Printf("reading from redis failed: %v", err)
+		return authCacheEntry{}, false
+	}
+	if len(fields) == 0 {
+		return authCacheEntry{}, false
+	}
+
+	expiry, err := strconv.ParseInt(fields["expiry"], 10, 64)
+	if err != nil {
+		return authCacheEntry{}, false
+	}
+	port, _ := strconv.Atoi(fields["port"])
+	return authCacheEntry{
+		username:      fields["username"],
+		password_hash: []byte(fields["password_hash"]),
+		expiry:        time.UnixMilli(expiry),
+		server:        fields["server"],
+		port:          port,
+		upstream_user: fields["upstream_user"],
+		negative:      fields["negative"] == "1",
+	}, true
+}
+
+func (cache *redisAuthCache) put(key string, entry authCacheEntry) error {
+	key = cache.key_prefix + key
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_TIMEOUT)
+	defer cancel()
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, map[string]any{
+			"username":      entry.username,
+			"password_hash": entry.password_hash,
+			"expiry":        entry.expiry.UnixMilli(),
+			"server":        entry.server,
+			"port":          entry.port,
+			"upstream_user": entry.upstream_user,
+			"negative":      entry.negative,
+		})
+		pipe.PExpireAt(ctx, key, entry.removalTime(cache.stale_grace))
+		return nil
+	})
+	return err
+}
+
+func (cache *redisAuthCache) delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_TIMEOUT)
+	defer cancel()
+	return cache.client.Del(ctx, cache.key_prefix+key).Err()
+}
+
+func (cache *redisAuthCache) deleteAll(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed_keys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed_keys = append(prefixed_keys, cache.key_prefix+key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_LIST_TIMEOUT)
+	defer cancel()
+	return cache.client.Del(ctx, prefixed_keys...).Err()
+}
+
+func (cache *redisAuthCache) close() error {
+	return cache.client.Close()
+}
+
+func (cache *redisAuthCache) list() (map[string]authCacheEntry, error) {
+	entries := make(map[string]authCacheEntry)
+	ctx, cancel := context.WithTimeout(context.Background(), REDIS_LIST_TIMEOUT)
+	defer cancel()
+	iterator := cache.client.Scan(ctx, 0, cache.key_prefix+"*", 0).Iterator()
+	for iterator.Next(ctx) {
+		key := strings.TrimPrefix(iterator.Val(), cache.key_prefix)
+		if entry, found := cache.get(key); found {
+			entries[key] = entry
+		}
+	}
+	return entries, iterator.Err()
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestRedisAuthCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: expiry, server: "imap2.example.org", port: 1993, upstream_user: "test*master"}))
+	entry, found := cache.get("test")
+	asserts.AssertEquals(t, true, found)
+	asserts.AssertEquals(t, "test", entry.username)
+	asserts.AssertEquals(t, "hash", string(entry.password_hash))
+	asserts.AssertEquals(t, true, expiry.Equal(entry.expiry))
+	asserts.AssertEquals(t, "imap2.example.org", entry.server)
+	asserts.AssertEquals(t, 1993, entry.port)
+	asserts.AssertEquals(t, "test*master", entry.upstream_user)
+	asserts.AssertEquals(t, true, server.Exists("test:test"))
+
+	asserts.AssertNil(t, cache.delete("test"))
+	_, found = cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestRedisAuthCacheEntriesExpire(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	server.FastForward(2 * time.Minute)
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestRedisAuthCacheKeepsStaleEntries(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 5*time.Minute)
+
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	asserts.AssertNil(t, cache.put("negative", authCacheEntry{username: "test", expiry: time.Now().Add(time.Minute), negative: true}))
+	server.FastForward(2 * time.Minute)
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, true, found)
+	_, found = cache.get("negative")
+	asserts.AssertEquals(t, false, found)
+
+	server.FastForward(5 * time.Minute)
+	_, found = cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestRedisAuthCacheSharedBetweenInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+	other_cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	_, found := other_cache.get("test")
+	asserts.AssertEquals(t, true, found)
+}
+
+func TestRedisAuthCacheServerUnavailable(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+	server.Close()
+
+	// an unavailable redis counts as cache miss without delaying the login
+	start := time.Now()
+	asserts.AssertNonNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+	asserts.AssertEquals(t, true, time.Since(start) < 2*REDIS_TIMEOUT)
+}
+
+func TestRedisAuthCacheList(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+	server.Set("other", "value")
+
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	asserts.AssertNil(t, cache.put("test2", authCacheEntry{username: "test2", expiry: time.Now().Add(time.Minute), negative: true}))
+
+	entries, err := cache.list()
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 2, len(entries))
+	asserts.AssertEquals(t, "test", entries["test"].username)
+	asserts.AssertEquals(t, true, entries["test2"].negative)
+}
+
+func TestRedisAuthCacheClose(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+	asserts.AssertNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+
+	asserts.AssertNil(t, cache.close())
+	asserts.AssertNonNil(t, cache.put("test", authCacheEntry{username: "test", password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	_, found := cache.get("test")
+	asserts.AssertEquals(t, false, found)
+}
+
+func TestRedisAuthCacheDeleteAll(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := createRedisAuthCache(server.Addr(), "", 0, "test:", 0)
+	for _, key := range []string{"a", "b", "c"} {
+		asserts.AssertNil(t, cache.put(key, authCacheEntry{username: key, password_hash: []byte("hash"), expiry: time.Now().Add(time.Minute)}))
+	}
+
+	asserts.AssertNil(t, cache.deleteAll([]string{"a", "b"}))
+	asserts.AssertNil(t, cache.deleteAll(nil))
+	asserts.AssertEquals(t, false, server.Exists("test:a"))
+	asserts.AssertEquals(t, false, server.Exists("test:b"))
+	asserts.AssertEquals(t, true, server.Exists("test:c"))
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_SMTP_PORT     = 587
+	DEFAULT_DNS_CACHE_TTL = 5 * time.Minute
+)
+
+// authRoute holds the upstreams and the validation of a group of users, e.g. of
+// all users of a mail domain.
+type authRoute struct {
+	domains             []string
+	users               []string
+	imap_upstreams      *imapUpstreamPool
+	smtp_host           string
+	smtp_port           int
+	smtp_user           string
+	smtp_password       string
+	imap_login_format   string
+	imap_login_password string
+	discovery           *upstreamDiscovery
+	validator           CredentialsValidator
+	cache_per_protocol  bool
+	closers             closeFuncs
+}
+
+// createRoute creates the route of the configuration. Discovery is only used if
+// the configuration enables it.
+func createRoute(cfg Configuration, imap_validator ImapValidator, discovery *upstreamDiscovery, upstream_pools *imapUpstreamPools) (*authRoute, error) {
+	imap_upstreams, err := upstream_pools.get(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tls_settings, err := createImapTlsSettings(cfg.CaCertFile, cfg.ImapTlsConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	default_backend := createImapPoolBackend(imap_validator, imap_upstreams, tls_settings)
+	if cfg.UpstreamDiscovery {
+		default_backend = createImapDiscoveryBackend(imap_validator, discovery, tls_settings, default_backend)
+	} else {
+		discovery = nil
+	}
+
+	var closers closeFuncs
+	validator, err := createValidator(cfg, imap_validator, default_backend, &closers)
+	if err != nil {
+		closers.closeAll()
+		return nil, err
+	}
+
+	smtp_port := cfg.SmtpPort
+	if smtp_port == 0 {
+		smtp_port = DEFAULT_SMTP_PORT
+	}
+
+	return &authRoute{
+		imap_upstreams:      imap_upstreams,
+		smtp_host:           cfg.SmtpServer,
+		smtp_port:           smtp_port,
+		smtp_user:           cfg.SmtpUser,
+		smtp_password:       cfg.SmtpPass,
+		imap_login_format:   cfg.ImapLoginFormat,
+		imap_login_password: cfg.ImapLoginPassword,
+		discovery:           discovery,
+		validator:           validator,
+		cache_per_protocol:  decidesByProtocol(cfg.Backends),
+		closers:             closers,
+	}, nil
+}
+
+// createRoutes returns the default route built from the top level settings and
+// a route per configured routing rule.
+func createRoutes(cfg Configuration, imap_validator ImapValidator, resolver Resolver, metrics *Metrics) (*authRoute, []*authRoute, error) {
+	dns_cache_ttl := cfg.DnsCacheTtl
+	if dns_cache_ttl == 0 {
+		dns_cache_ttl = DEFAULT_DNS_CACHE_TTL
+	}
+	discovery := createUpstreamDiscovery(resolver, dns_cache_ttl)
+	upstream_pools := createImapUpstreamPools(metrics)
+
+	default_route, err := createRoute(cfg, imap_validator, discovery, upstream_pools)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routes := make([]*authRoute, 0, len(cfg.Routes))
+	for _, route_cfg := range cfg.Routes {
+		route, err := createRoute(cfg.withRoute(route_cfg), imap_validator, discovery, upstream_pools)
+		if err != nil {
+			stopRoutes(default_route, routes)
+			return nil, nil, err
+		}
+		route.users = route_cfg.Users
+		for _, domain := range route_cfg.Domains {
+			route.domains = append(route.domains, strings.ToLower(domain))
+		}
+		routes = append(routes, route)
+	}
+	return default_route, routes, nil
+}
+
+// withRoute returns the configuration with all settings replaced that are set
+// by the route. Upstreams and backends are replaced as a whole.
+func (cfg Configuration) withRoute(route RouteConfiguration) Configuration {
+	if route.ImapServer != "" || len(route.ImapUpstreams) > 0 {
+		cfg.ImapServer = route.ImapServer
+		cfg.ImapPort = route.ImapPort
+		cfg.ImapUpstreams = route.ImapUpstreams
+	}
+	if route.ImapUpstreamStrategy != "" {
+		cfg.ImapUpstreamStrategy = route.ImapUpstreamStrategy
+	}
+	if route.CaCertFile != "" {
+		cfg.CaCertFile = route.CaCertFile
+	}
+	if route.SmtpServer != "" {
+		cfg.SmtpServer = route.SmtpServer
+		cfg.SmtpPort = route.SmtpPort
+		cfg.SmtpUser = route.SmtpUser
+		cfg.SmtpPass = route.SmtpPass
+	}
+	if route.ImapLoginFormat != "" || route.ImapLoginPassword != "" {
+		cfg.ImapLoginFormat = route.ImapLoginFormat
+		cfg.ImapLoginPassword = route.ImapLoginPassword
+	}
+	if route.UpstreamDiscovery != nil {
+		cfg.UpstreamDiscovery = *route.UpstreamDiscovery
+	}
+	if len(route.Backends) > 0 {
+		cfg.BackendPolicy = route.BackendPolicy
+		cfg.Backends = route.Backends
+	}
+	return cfg
+}
+
+// selectRoute returns the route of the user. Routes listing the user explicitly
+// take precedence over routes matching the domain of the user.
+func selectRoute(default_route *authRoute, routes []*authRoute, user string) *authRoute {
+	for _, route := range routes {
+		if slices.Contains(route.users, user) {
+			return route
+		}
+	}
+
+	_, domain := splitUser(user)
+	domain = strings.ToLower(domain)
+	if domain != "" {
+		for _, route := range routes {
+			if slices.Contains(route.domains, domain) {
+				return route
+			}
+		}
+	}
+	return default_route
+}
+
+// imapServer returns the IMAP server nginx should connect to for the user.
+// return: string (host), int (port)
+func (route *authRoute) imapServer(user string) (string, int) {
+	if host, port, found := route.discover(DISCOVERY_SERVICE_IMAPS, user); found {
+		return host, port
+	}
+	if upstream := route.imap_upstreams.selectUpstream(); upstream != nil {
+		return upstream.host, upstream.port
+	}
+	return "", 993
+}
+
+// formatImapLogin returns the username nginx should use to login to the IMAP
+// upstream, e.g. user*master for a master user of Dovecot. The format may
+// contain %u (user), %n (local part), %d (domain) and %% (percent sign).
+func (route *authRoute) formatImapLogin(user string) string {
+	local_part, domain := splitUser(user)
+	replacer := strings.NewReplacer("%%", "%", "%u", user, "%n", local_part, "%d", domain)
+	return replacer.Replace(route.imap_login_format)
+}
+
+// smtpServer returns the SMTP server nginx should connect to for the user.
+// return: string (host), int (port)
+func (route *authRoute) smtpServer(user string) (string, int) {
+	if host, port, found := route.discover(DISCOVERY_SERVICE_SUBMISSION, user); found {
+		return host, port
+	}
+	return route.smtp_host, route.smtp_port
+}
+
+// falls back to the configured servers if discovery is disabled or fails
+func (route *authRoute) discover(service, user string) (string, int, bool) {
+	if route.discovery == nil {
+		return "", 0, false
+	}
+	_, domain := splitUser(user)
+	host, port, err := route.discovery.discover(service, domain)
+	if err != nil {
+		log.Printf("discovering %v server failed: %v", service, err)
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+// stopRoutes stops the default route and the routes and releases the
+// connections of their backends.
+func stopRoutes(default_route *authRoute, routes []*authRoute) {
+	default_route.Stop()
+	for _, route := range routes {
+		route.Stop()
+	}
+}
+
+// cacheKey returns the key of the successful authentication of the user. If
+// the backends may decide by protocol, authentications are cached per protocol,
+// so that e.g. an IMAP login does not allow SMTP.
+func (route *authRoute) cacheKey(protocol, user string) string {
+	if !route.cache_per_protocol {
+		return user
+	}
+	return protocol + ":" + user
+}
+
+func (route *authRoute) Stop() {
+	route.imap_upstreams.Stop()
+	route.closers.closeAll()
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func TestSelectRoute(t *testing.T) {
+	default_route := &authRoute{}
+	domain_route := &authRoute{domains: []string{"tenant.org"}}
+	user_route := &authRoute{users: []string{"boss@tenant.org"}}
+	routes := []*authRoute{domain_route, user_route}
+
+	asserts.AssertEquals(t, domain_route, selectRoute(default_route, routes, "user@tenant.org"))
+	asserts.AssertEquals(t, domain_route, selectRoute(default_route, routes, "user@Tenant.ORG"))
+	asserts.AssertEquals(t, user_route, selectRoute(default_route, routes, "boss@tenant.org"))
+	asserts.AssertEquals(t, default_route, selectRoute(default_route, routes, "user@example.org"))
+	asserts.AssertEquals(t, default_route, selectRoute(default_route, routes, "tenant.org"))
+}
+
+func TestConfigurationWithRoute(t *testing.T) {
+	cfg := Configuration{
+		ImapServer:    "imap.example.org",
+		ImapUpstreams: []ImapUpstreamConfiguration{{Host: "imap1.example.org"}},
+		SmtpServer:    "smtp.example.org",
+		SmtpUser:      "user",
+		CaCertFile:    "/ca.crt",
+	}
+
+	route_cfg := cfg.withRoute(RouteConfiguration{ImapServer: "imap.tenant.org", SmtpServer: "smtp.tenant.org"})
+	asserts.AssertEquals(t, "imap.tenant.org", route_cfg.ImapServer)
+	asserts.AssertEquals(t, 0, len(route_cfg.ImapUpstreams))
+	asserts.AssertEquals(t, "smtp.tenant.org", route_cfg.SmtpServer)
+	asserts.AssertEquals(t, "", route_cfg.SmtpUser)
+	asserts.AssertEquals(t, "/ca.crt", route_cfg.CaCertFile)
+
+	// settings not set by the route are kept
+	route_cfg = cfg.withRoute(RouteConfiguration{})
+	asserts.AssertEquals(t, "imap.example.org", route_cfg.ImapServer)
+	asserts.AssertEquals(t, 1, len(route_cfg.ImapUpstreams))
+	asserts.AssertEquals(t, "user", route_cfg.SmtpUser)
+
+	cfg.ImapLoginFormat = "%u*master"
+	cfg.ImapLoginPassword = "masterpass"
+	route_cfg = cfg.withRoute(RouteConfiguration{ImapLoginFormat: "%n"})
+	asserts.AssertEquals(t, "%n", route_cfg.ImapLoginFormat)
+	asserts.AssertEquals(t, "", route_cfg.ImapLoginPassword)
+	route_cfg = cfg.withRoute(RouteConfiguration{})
+	asserts.AssertEquals(t, "%u*master", route_cfg.ImapLoginFormat)
+	asserts.AssertEquals(t, "masterpass", route_cfg.ImapLoginPassword)
+
+	disabled := false
+	cfg.UpstreamDiscovery = true
+	route_cfg = cfg.withRoute(RouteConfiguration{UpstreamDiscovery: &disabled})
+	asserts.AssertEquals(t, false, route_cfg.UpstreamDiscovery)
+}
+
+func TestFormatImapLogin(t *testing.T) {
+	route := &authRoute{imap_login_format: "%u*master"}
+	asserts.AssertEquals(t, "user@example.org*master", route.formatImapLogin("user@example.org"))
+
+	route = &authRoute{imap_login_format: "%d\\%n 100%%"}
+	asserts.AssertEquals(t, "example.org\\user 100%", route.formatImapLogin("user@example.org"))
+	asserts.AssertEquals(t, "\\user 100%", route.formatImapLogin("user"))
+}
+
+func TestRoutedAuthRequests(t *testing.T) {
+	var cfg Configuration
+	asserts.AssertNil(t, cfg.Load("testdata/config_routes.yaml"))
+
+	var queried_hosts []string
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		queried_hosts = append(queried_hosts, imap_host)
+		return ValidationResult{Decision: true, Valid: true}
+	}, createFakeResolver(), time.Minute)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "user@tenant.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "198.51.100.10", response.Server)
+	asserts.AssertEquals(t, 1993, response.Port)
+	asserts.AssertEquals(t, "user@tenant.org*master", response.User)
+	asserts.AssertEquals(t, "masterpass", response.Password)
+
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "user@tenant.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "198.51.100.25", response.Server)
+	asserts.AssertEquals(t, 465, response.Port)
+	asserts.AssertEquals(t, "tenant", response.User)
+	asserts.AssertEquals(t, "secret", response.Password)
+
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "user@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.25", response.Server)
+	asserts.AssertEquals(t, 587, response.Port)
+
+	// the login of the client is forwarded to the default IMAP upstream
+	response = handler.HandleAuthRequest(context.Background(), "imap", "user@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "", response.User)
+	asserts.AssertEquals(t, "", response.Password)
+
+	// the second request of the tenant user is served from the cache
+	asserts.AssertStringArraysEquals(t, []string{"imap.tenant.org", "imap.example.org"}, queried_hosts)
+}
+
+func TestRouteWithOwnBackends(t *testing.T) {
+	var cfg Configuration
+	asserts.AssertNil(t, cfg.Load("testdata/config_routes.yaml"))
+	asserts.AssertEquals(t, POLICY_FIRST_SUCCESS, cfg.Routes[1].BackendPolicy)
+
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		t.Fatal("the route validates at dovecot only")
+		return ValidationResult{Decision: false, Valid: false}
+	}, createFakeResolver(), time.Minute)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+
+	// dovecot is not running
+	response := handler.HandleAuthRequest(context.Background(), "imap", "boss@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "[UNAVAILABLE] Temporary server problem, try again later", response.Status)
+
+	// only the route validating at dovecot caches per protocol
+	asserts.AssertEquals(t, "boss@example.org", handler.default_route.cacheKey("imap", "boss@example.org"))
+	asserts.AssertEquals(t, "imap:boss@example.org", handler.routes[1].cacheKey("imap", "boss@example.org"))
+}
+
+func TestRoutesShareUpstreamPools(t *testing.T) {
+	cfg := Configuration{
+		ImapUpstreams: []ImapUpstreamConfiguration{{Host: "imap1"}, {Host: "imap2"}},
+		Routes: []RouteConfiguration{
+			{Domains: []string{"tenant.org"}, SmtpServer: "smtp.tenant.org"},
+			{Domains: []string{"other.org"}, ImapUpstreams: []ImapUpstreamConfiguration{{Host: "imap2"}, {Host: "imap3"}}},
+		},
+	}
+	default_route, routes, err := createRoutes(cfg, nil, createFakeResolver(), CreateMetrics())
+	asserts.AssertNil(t, err)
+	defer stopRoutes(default_route, routes)
+
+	// routes inheriting the upstreams use the same pool
+	asserts.AssertEquals(t, default_route.imap_upstreams, routes[0].imap_upstreams)
+	asserts.AssertNotEquals(t, default_route.imap_upstreams, routes[1].imap_upstreams)
+	// upstreams in several pools share their health
+	asserts.AssertEquals(t, default_route.imap_upstreams.upstreams[1], routes[1].imap_upstreams.upstreams[0])
+
+	// the health checks of a shared pool run once
+	default_route.imap_upstreams.startHealthChecks(time.Hour, isImapUpstreamReachable)
+	stop := default_route.imap_upstreams.stop
+	routes[0].imap_upstreams.startHealthChecks(time.Hour, isImapUpstreamReachable)
+	asserts.AssertEquals(t, stop, routes[0].imap_upstreams.stop)
+}
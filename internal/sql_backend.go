@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQL_DRIVER_SQLITE   = "sqlite"
+	SQL_DRIVER_MYSQL    = "mysql"
+	SQL_DRIVER_POSTGRES = "postgres"
+
+	// matches the mailbox table of Postfixadmin
+	DEFAULT_SQL_QUERY = "SELECT password FROM mailbox WHERE username = %u AND active = '1'"
+)
+
+// createSqlBackend validates credentials against the password hash queried
+// from a database. The connections to the database are closed by closers.
+func createSqlBackend(driver, dsn, query_template string, closers *closeFuncs) (CredentialsValidator, error) {
+	query, parameters, err := compileSqlQuery(driver, query_template)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	closers.add(db.Close)
+
+	return func(request ValidationRequest) ValidationResult {
+		args := make([]any, 0, len(parameters))
+		for _, parameter := range parameters {
+			args = append(args, parameter(request.User))
+		}
+
+		var hash string
+		err := db.QueryRowContext(request.Context(), query, args...).Scan(&hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ValidationResult{Decision: false, Valid: true}
+		}
+		if err != nil {
+			log.Printf("querying password hash failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false, Timeout: isTimeout(request.Context(), err)}
+		}
+
+		match, err := verifyPasswordHash(hash, []byte(request.Pass))
+		if err != nil {
+			log.Printf("verifying password hash failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false}
+		}
+		return ValidationResult{Decision: match, Valid: true}
+	}, nil
+}
+
+// compileSqlQuery replaces the Dovecot style variables %u (user), %n (local part
+// of user) and %d (domain of user) by placeholders of the given driver, so
+// that the user is never interpolated into the query itself.
+func compileSqlQuery(driver, query_template string) (string, []func(string) string, error) {
+	var query strings.Builder
+	var parameters []func(string) string
+
+	for i := 0; i < len(query_template); i++ {
+		if query_template[i] != '%' {
+			query.WriteByte(query_template[i])
+			continue
+		}
+		if i+1 >= len(query_template) {
+			return "", nil, fmt.Errorf("incomplete variable at end of query")
+		}
+
+		i++
+		switch query_template[i] {
+		case '%':
+			query.WriteByte('%')
+			continue
+		case 'u':
+			parameters = append(parameters, func(user string) string { return user })
+		case 'n':
+			parameters = append(parameters, func(user string) string {
+				local_part, _ := splitUser(user)
+				return local_part
+			})
+		case 'd':
+			parameters = append(parameters, func(user string) string {
+				_, domain := splitUser(user)
+				return domain
+			})
+		default:
+			return "", nil, fmt.Errorf("unsupported variable %%%c in query", query_template[i])
+		}
+
+		if driver == SQL_DRIVER_POSTGRES {
+			query.WriteString("$" + strconv.Itoa(len(parameters)))
+		} else {
+			query.WriteByte('?')
+		}
+	}
+
+	return query.String(), parameters, nil
+}
+
+// return: string (local part), string (domain, empty if there is none)
+func splitUser(user string) (string, string) {
+	separator := strings.LastIndex(user, "@")
+	if separator < 0 {
+		return user, ""
+	}
+	return user[:separator], user[separator+1:]
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSqlBackendValidCredentials(t *testing.T) {
+	backend := createTestSqlBackend(t, DEFAULT_SQL_QUERY)
+	result := backend(ValidationRequest{User: "test@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestSqlBackendInvalidCredentials(t *testing.T) {
+	backend := createTestSqlBackend(t, DEFAULT_SQL_QUERY)
+	result := backend(ValidationRequest{User: "test@example.org", Pass: "wrong"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestSqlBackendInactiveUser(t *testing.T) {
+	backend := createTestSqlBackend(t, DEFAULT_SQL_QUERY)
+	result := backend(ValidationRequest{User: "inactive@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestSqlBackendUnsupportedHash(t *testing.T) {
+	backend := createTestSqlBackend(t, DEFAULT_SQL_QUERY)
+	result := backend(ValidationRequest{User: "broken@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestSqlBackendQueryWithLocalPartAndDomain(t *testing.T) {
+	backend := createTestSqlBackend(t, "SELECT password FROM mailbox WHERE local_part = %n AND domain = %d")
+	result := backend(ValidationRequest{User: "test@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestSqlBackendBrokenQuery(t *testing.T) {
+	backend := createTestSqlBackend(t, "SELECT password FROM doesnotexist WHERE username = %u")
+	result := backend(ValidationRequest{User: "test@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestCompileSqlQuery(t *testing.T) {
+	query, parameters, err := compileSqlQuery(SQL_DRIVER_POSTGRES, "SELECT password FROM users WHERE name = %n AND domain = %d AND name LIKE '%%'")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "SELECT password FROM users WHERE name = $1 AND domain = $2 AND name LIKE '%'", query)
+	asserts.AssertEquals(t, 2, len(parameters))
+	asserts.AssertEquals(t, "test", parameters[0]("test@example.org"))
+	asserts.AssertEquals(t, "example.org", parameters[1]("test@example.org"))
+
+	query, _, err = compileSqlQuery(SQL_DRIVER_MYSQL, "SELECT password FROM users WHERE name = %u")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "SELECT password FROM users WHERE name = ?", query)
+
+	_, _, err = compileSqlQuery(SQL_DRIVER_MYSQL, "SELECT password FROM users WHERE name = %x")
+	asserts.AssertNonNil(t, err)
+}
+
+func createTestSqlBackend(t *testing.T, query string) CredentialsValidator {
+	dsn := t.TempDir() + "/users.db"
+	db, err := sql.Open(SQL_DRIVER_SQLITE, dsn)
+	asserts.AssertNil(t, err)
+	defer db.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	asserts.AssertNil(t, err)
+
+	_, err = db.Exec("CREATE TABLE mailbox (username TEXT, local_part TEXT, domain TEXT, password TEXT, active TEXT)")
+	asserts.AssertNil(t, err)
+	_, err = db.Exec("INSERT INTO mailbox VALUES (?, ?, ?, ?, ?), (?, ?, ?, ?, ?), (?, ?, ?, ?, ?)",
+		"test@example.org", "test", "example.org", "{BLF-CRYPT}"+string(hash), "1",
+		"inactive@example.org", "inactive", "example.org", "{BLF-CRYPT}"+string(hash), "0",
+		"broken@example.org", "broken", "example.org", "{FOO}secret", "1")
+	asserts.AssertNil(t, err)
+
+	closers := &closeFuncs{}
+	t.Cleanup(closers.closeAll)
+	backend, err := createSqlBackend(SQL_DRIVER_SQLITE, dsn, query, closers)
+	asserts.AssertNil(t, err)
+	return backend
+}
+
+func TestSqlBackendCanceledRequest(t *testing.T) {
+	backend := createTestSqlBackend(t, DEFAULT_SQL_QUERY)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := backend(ValidationRequest{Ctx: ctx, User: "test@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+}
+
+func TestSqlBackendClosesDatabase(t *testing.T) {
+	closers := &closeFuncs{}
+	backend, err := createSqlBackend(SQL_DRIVER_SQLITE, t.TempDir()+"/users.db", DEFAULT_SQL_QUERY, closers)
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 1, len(*closers))
+
+	closers.closeAll()
+	result := backend(ValidationRequest{User: "test@example.org", Pass: "secret"})
+	asserts.AssertEquals(t, false, result.Valid)
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RFC 6186 services
+	DISCOVERY_SERVICE_IMAPS      = "imaps"
+	DISCOVERY_SERVICE_SUBMISSION = "submission"
+
+	DISCOVERY_TIMEOUT = 5 * time.Second
+	// failures are cached shorter, so that fixed records are picked up soon
+	DISCOVERY_FAILURE_TTL = 30 * time.Second
+)
+
+// Resolver is implemented by *net.Resolver. Tests use a fake resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// discoveredUpstream is either a discovered server or the error of a failed
+// discovery.
+type discoveredUpstream struct {
+	host   string
+	port   int
+	err    error
+	expiry time.Time
+}
+
+// upstreamDiscovery finds the IMAP and SMTP servers of a mail domain via SRV
+// records. If a domain has no SRV record, its first MX host is used with the
+// default port of the service. Results are cached for ttl, as the resolver
+// does not expose the TTL of the records. Failures are cached as well, for at
+// most DISCOVERY_FAILURE_TTL, so that unknown domains do not cause a lookup on
+// every login.
+type upstreamDiscovery struct {
+	resolver Resolver
+	ttl      time.Duration
+	mutex    sync.Mutex
+	cache    map[string]discoveredUpstream
+}
+
+func createUpstreamDiscovery(resolver Resolver, ttl time.Duration) *upstreamDiscovery {
+	return &upstreamDiscovery{
+		resolver: resolver,
+		ttl:      ttl,
+		cache:    make(map[string]discoveredUpstream),
+	}
+}
+
+// return: string (host), int (port), error
+func (discovery *upstreamDiscovery) discover(service, domain string) (string, int, error) {
+	if domain == "" {
+		return "", 0, fmt.Errorf("no domain to discover %v server for", service)
+	}
+	domain = strings.ToLower(domain)
+	key := service + "/" + domain
+
+	discovery.mutex.Lock()
+	upstream, found := discovery.cache[key]
+	discovery.mutex.Unlock()
+	if found && time.Now().Before(upstream.expiry) {
+		return upstream.host, upstream.port, upstream.err
+	}
+
+	host, port, err := discovery.lookup(service, domain)
+	ttl := discovery.ttl
+	if err != nil {
+		ttl = min(ttl, DISCOVERY_FAILURE_TTL)
+	}
+
+	discovery.mutex.Lock()
+	discovery.cache[key] = discoveredUpstream{host: host, port: port, err: err, expiry: time.Now().Add(ttl)}
+	discovery.mutex.Unlock()
+	return host, port, err
+}
+
+func (discovery *upstreamDiscovery) lookup(service, domain string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DISCOVERY_TIMEOUT)
+	defer cancel()
+
+	// the records are ordered by priority and weight already
+	_, records, err := discovery.resolver.LookupSRV(ctx, service, "tcp", domain)
+	if err == nil && len(records) > 0 {
+		// a single record with target "." means that the service is not provided
+		if records[0].Target == "." {
+			return "", 0, fmt.Errorf("%v is not provided for %v", service, domain)
+		}
+		return strings.TrimSuffix(records[0].Target, "."), int(records[0].Port), nil
+	}
+
+	mx_records, mx_err := discovery.resolver.LookupMX(ctx, domain)
+	if mx_err != nil || len(mx_records) == 0 {
+		return "", 0, fmt.Errorf("neither SRV nor MX records found for %v: %v", domain, err)
+	}
+	return strings.TrimSuffix(mx_records[0].Host, "."), defaultServicePort(service), nil
+}
+
+func defaultServicePort(service string) int {
+	if service == DISCOVERY_SERVICE_IMAPS {
+		return 993
+	}
+	return DEFAULT_SMTP_PORT
+}
+
+// createImapDiscoveryBackend validates credentials at the IMAP server discovered
+// for the domain of the user. Users whose server cannot be discovered are
+// validated by the fallback.
+func createImapDiscoveryBackend(imap_validator ImapValidator, discovery *upstreamDiscovery, tls_settings ImapTlsSettings, fallback CredentialsValidator) CredentialsValidator {
+	return func(request ValidationRequest) ValidationResult {
+		_, domain := splitUser(request.User)
+		host, port, err := discovery.discover(DISCOVERY_SERVICE_IMAPS, domain)
+		if err != nil {
+			log.Printf("discovering IMAP server failed: %v", err)
+			return fallback(request)
+		}
+		return imap_validator(request.Context(), host, port, request.User, request.Pass, tls_settings)
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+type fakeResolver struct {
+	srv     map[string][]*net.SRV
+	mx      map[string][]*net.MX
+	ips     map[string][]net.IP
+	lookups int
+}
+
+func (resolver *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	resolver.lookups++
+	cname := "_" + service + "._" + proto + "." + name
+	records, found := resolver.srv[cname]
+	if !found {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func (resolver *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	resolver.lookups++
+	records, found := resolver.mx[name]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func (resolver *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	resolver.lookups++
+	ips, found := resolver.ips[host]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func createFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_imaps._tcp.example.org":      {{Target: "imap.example.org.", Port: 993}, {Target: "imap2.example.org.", Port: 993}},
+			"_submission._tcp.example.org": {{Target: "smtp.example.org.", Port: 587}},
+			"_imaps._tcp.noimap.org":       {{Target: ".", Port: 0}},
+		},
+		mx: map[string][]*net.MX{
+			"mx-only.org": {{Host: "mail.mx-only.org.", Pref: 10}},
+		},
+		ips: map[string][]net.IP{
+			"imap.example.org":      {net.ParseIP("192.0.2.10")},
+			"imap2.example.org":     {net.ParseIP("192.0.2.11")},
+			"imap.fallback.org":     {net.ParseIP("192.0.2.12")},
+			"smtp.example.org":      {net.ParseIP("192.0.2.25")},
+			"smtp.fallback.org":     {net.ParseIP("192.0.2.26")},
+			"imap.tenant.org":       {net.ParseIP("198.51.100.10")},
+			"smtp.tenant.org":       {net.ParseIP("198.51.100.25")},
+			"dualstack.example.org": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+			"multi.example.org":     {net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")},
+		},
+	}
+}
+
+func TestDiscoverViaSrv(t *testing.T) {
+	discovery := createUpstreamDiscovery(createFakeResolver(), time.Minute)
+
+	host, port, err := discovery.discover(DISCOVERY_SERVICE_IMAPS, "example.org")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "imap.example.org", host)
+	asserts.AssertEquals(t, 993, port)
+
+	host, port, err = discovery.discover(DISCOVERY_SERVICE_SUBMISSION, "Example.ORG")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "smtp.example.org", host)
+	asserts.AssertEquals(t, 587, port)
+}
+
+func TestDiscoverViaMx(t *testing.T) {
+	discovery := createUpstreamDiscovery(createFakeResolver(), time.Minute)
+
+	host, port, err := discovery.discover(DISCOVERY_SERVICE_IMAPS, "mx-only.org")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, "mail.mx-only.org", host)
+	asserts.AssertEquals(t, 993, port)
+
+	_, port, err = discovery.discover(DISCOVERY_SERVICE_SUBMISSION, "mx-only.org")
+	asserts.AssertNil(t, err)
+	asserts.AssertEquals(t, 587, port)
+}
+
+func TestDiscoverFails(t *testing.T) {
+	discovery := createUpstreamDiscovery(createFakeResolver(), time.Minute)
+
+	_, _, err := discovery.discover(DISCOVERY_SERVICE_IMAPS, "noimap.org")
+	asserts.AssertNonNil(t, err)
+	_, _, err = discovery.discover(DISCOVERY_SERVICE_IMAPS, "unknown.org")
+	asserts.AssertNonNil(t, err)
+	_, _, err = discovery.discover(DISCOVERY_SERVICE_IMAPS, "")
+	asserts.AssertNonNil(t, err)
+}
+
+func TestDiscoveryIsCached(t *testing.T) {
+	resolver := createFakeResolver()
+	discovery := createUpstreamDiscovery(resolver, 50*time.Millisecond)
+
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "example.org")
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "example.org")
+	asserts.AssertEquals(t, 1, resolver.lookups)
+
+	time.Sleep(100 * time.Millisecond)
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "example.org")
+	asserts.AssertEquals(t, 2, resolver.lookups)
+}
+
+func TestDiscoveryFailureIsCached(t *testing.T) {
+	resolver := createFakeResolver()
+	discovery := createUpstreamDiscovery(resolver, 50*time.Millisecond)
+
+	_, _, err := discovery.discover(DISCOVERY_SERVICE_IMAPS, "unknown.org")
+	asserts.AssertNonNil(t, err)
+	lookups := resolver.lookups
+	_, _, err = discovery.discover(DISCOVERY_SERVICE_IMAPS, "unknown.org")
+	asserts.AssertNonNil(t, err)
+	asserts.AssertEquals(t, lookups, resolver.lookups)
+
+	time.Sleep(100 * time.Millisecond)
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "unknown.org")
+	asserts.AssertEquals(t, 2*lookups, resolver.lookups)
+}
+
+func TestDiscoveryFailureIsCachedShorter(t *testing.T) {
+	discovery := createUpstreamDiscovery(createFakeResolver(), time.Hour)
+
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "example.org")
+	discovery.discover(DISCOVERY_SERVICE_IMAPS, "unknown.org")
+	asserts.AssertEquals(t, true, time.Until(discovery.cache["imaps/example.org"].expiry) > 59*time.Minute)
+	asserts.AssertEquals(t, true, time.Until(discovery.cache["imaps/unknown.org"].expiry) <= DISCOVERY_FAILURE_TTL)
+}
+
+func TestAuthRequestWithDiscoveredUpstreams(t *testing.T) {
+	cfg := Configuration{
+		WhitelistedUsers:  []string{"user@example.org", "user@unknown.org"},
+		ImapServer:        "imap.fallback.org",
+		SmtpServer:        "smtp.fallback.org",
+		UpstreamDiscovery: true,
+	}
+	var queried_hosts []string
+	handler, err := CreateAuthHandlerWithCustomCallbacks(cfg, func(ctx context.Context, imap_host string, imap_port int, user, pass string, tls_settings ImapTlsSettings) ValidationResult {
+		queried_hosts = append(queried_hosts, imap_host)
+		return ValidationResult{Decision: true, Valid: true}
+	}, createFakeResolver(), time.Minute)
+	asserts.AssertNil(t, err)
+	defer handler.Close()
+
+	response := handler.HandleAuthRequest(context.Background(), "imap", "user@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.10", response.Server)
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "user@example.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.25", response.Server)
+
+	// the configured servers are used if discovery fails
+	response = handler.HandleAuthRequest(context.Background(), "smtp", "user@unknown.org", "test", "127.0.0.1", 1)
+	asserts.AssertEquals(t, "OK", response.Status)
+	asserts.AssertEquals(t, "192.0.2.26", response.Server)
+
+	asserts.AssertStringArraysEquals(t, []string{"imap.example.org", "imap.fallback.org"}, queried_hosts)
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// userRewriter canonicalises usernames before they are checked against the
+// whitelist, cached and validated. The rules are applied in this order:
+// lowercasing, appending the default domain, the substitutions in
+// configuration order and finally the aliases.
+type userRewriter struct {
+	lowercase        bool
+	default_domain   string
+	substitutions    []userSubstitution
+	aliases          map[string]string
+	return_canonical bool
+}
+
+type userSubstitution struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func createUserRewriter(cfg Configuration) (*userRewriter, error) {
+	rewriter := &userRewriter{
+		lowercase:        cfg.UserLowercase,
+		default_domain:   cfg.UserDefaultDomain,
+		aliases:          cfg.UserAliases,
+		return_canonical: cfg.UserReturnCanonical,
+	}
+	for _, substitution_cfg := range cfg.UserSubstitutions {
+		pattern, err := regexp.Compile(substitution_cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user substitution %q: %w", substitution_cfg.Pattern, err)
+		}
+		rewriter.substitutions = append(rewriter.substitutions, userSubstitution{pattern: pattern, replacement: substitution_cfg.Replacement})
+	}
+	return rewriter, nil
+}
+
+// rewrite returns the canonical name of the user.
+func (rewriter *userRewriter) rewrite(user string) string {
+	if rewriter.lowercase {
+		user = strings.ToLower(user)
+	}
+	if rewriter.default_domain != "" && user != "" && !strings.Contains(user, "@") {
+		user = user + "@" + rewriter.default_domain
+	}
+	for _, substitution := range rewriter.substitutions {
+		user = substitution.pattern.ReplaceAllString(user, substitution.replacement)
+	}
+	if alias, found := rewriter.aliases[user]; found {
+		user = alias
+	}
+	return user
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+func createTestUserRewriter(t *testing.T, cfg Configuration) *userRewriter {
+	rewriter, err := createUserRewriter(cfg)
+	asserts.AssertNil(t, err)
+	return rewriter
+}
+
+func TestUserRewriterWithoutRules(t *testing.T) {
+	rewriter := createTestUserRewriter(t, Configuration{})
+	asserts.AssertEquals(t, "Test@Example.org", rewriter.rewrite("Test@Example.org"))
+	asserts.AssertEquals(t, "", rewriter.rewrite(""))
+}
+
+func TestUserRewriterLowercase(t *testing.T) {
+	rewriter := createTestUserRewriter(t, Configuration{UserLowercase: true})
+	asserts.AssertEquals(t, "test@example.org", rewriter.rewrite("Test@Example.ORG"))
+}
+
+func TestUserRewriterDefaultDomain(t *testing.T) {
+	rewriter := createTestUserRewriter(t, Configuration{UserDefaultDomain: "example.org"})
+	asserts.AssertEquals(t, "test@example.org", rewriter.rewrite("test"))
+	asserts.AssertEquals(t, "test@example.com", rewriter.rewrite("test@example.com"))
+	asserts.AssertEquals(t, "", rewriter.rewrite(""))
+}
+
+func TestUserRewriterSubstitutions(t *testing.T) {
+	rewriter := createTestUserRewriter(t, Configuration{UserSubstitutions: []UserSubstitutionConfiguration{
+		{Pattern: `^([^+@]+)\+[^@]*@`, Replacement: "$1@"},
+		{Pattern: `@mail\.example\.org$`, Replacement: "@example.org"},
+	}})
+	asserts.AssertEquals(t, "test@example.org", rewriter.rewrite("test+lists@mail.example.org"))
+	asserts.AssertEquals(t, "other@example.com", rewriter.rewrite("other@example.com"))
+}
+
+func TestUserRewriterAliases(t *testing.T) {
+	rewriter := createTestUserRewriter(t, Configuration{
+		UserLowercase:     true,
+		UserDefaultDomain: "example.org",
+		UserAliases:       map[string]string{"postmaster@example.org": "admin@example.org"},
+	})
+	// aliases are looked up after the other rules
+	asserts.AssertEquals(t, "admin@example.org", rewriter.rewrite("PostMaster"))
+	asserts.AssertEquals(t, "test@example.org", rewriter.rewrite("test"))
+}
+
+func TestUserRewriterInvalidSubstitution(t *testing.T) {
+	_, err := createUserRewriter(Configuration{UserSubstitutions: []UserSubstitutionConfiguration{{Pattern: "("}}})
+	asserts.AssertNonNil(t, err)
+}
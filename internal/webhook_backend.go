@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// the password is sent as is
+	WEBHOOK_PASSWORD_PLAIN = "plain"
+	// only the hex encoded SHA-256 hash of the password is sent
+	WEBHOOK_PASSWORD_SHA256 = "sha256"
+)
+
+type webhookRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Protocol string `json:"protocol"`
+	ClientIp string `json:"client_ip"`
+}
+
+type webhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Server string `json:"server"`
+	Port   int    `json:"port"`
+	User   string `json:"user"`
+}
+
+// createWebhookBackend validates credentials by posting them as JSON to an HTTPS
+// endpoint. The endpoint decides via its JSON response and may route the user
+// to another server or rewrite the username. A non-2xx status means that the
+// endpoint could not decide.
+func createWebhookBackend(endpoint, password_encoding, ca_cert_file string, timeout time.Duration, closers *closeFuncs) (CredentialsValidator, error) {
+	endpoint_url, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint_url.Scheme != "https" {
+		return nil, fmt.Errorf("webhook endpoint %v does not use https", endpoint)
+	}
+	if password_encoding != WEBHOOK_PASSWORD_PLAIN && password_encoding != WEBHOOK_PASSWORD_SHA256 {
+		return nil, fmt.Errorf("unsupported webhook password encoding %q", password_encoding)
+	}
+
+	tls_config := &tls.Config{}
+	if ca_cert_file != "" {
+		ca_cert, err := os.ReadFile(ca_cert_file)
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(ca_cert) {
+			return nil, fmt.Errorf("no certificates found in %v", ca_cert_file)
+		}
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tls_config},
+	}
+	closers.add(func() error {
+		client.CloseIdleConnections()
+		return nil
+	})
+
+	return func(request ValidationRequest) ValidationResult {
+		payload := webhookRequest{
+			User:     request.User,
+			Password: request.Pass,
+			Protocol: request.Protocol,
+			ClientIp: request.ClientIp,
+		}
+		if password_encoding == WEBHOOK_PASSWORD_SHA256 {
+			hash := sha256.Sum256([]byte(request.Pass))
+			payload.Password = hex.EncodeToString(hash[:])
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return ValidationResult{Decision: false, Valid: false}
+		}
+
+		http_request, err := http.NewRequestWithContext(request.Context(), http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return ValidationResult{Decision: false, Valid: false}
+		}
+		http_request.Header.Set("Content-Type", "application/json")
+		http_response, err := client.Do(http_request)
+		if err != nil {
+			log.Printf("querying webhook failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false, Timeout: isTimeout(request.Context(), err)}
+		}
+		defer http_response.Body.Close()
+		if http_response.StatusCode < 200 || http_response.StatusCode > 299 {
+			log.Printf("webhook responded with status %v", http_response.Status)
+			return ValidationResult{Decision: false, Valid: false}
+		}
+
+		var response webhookResponse
+		if err := json.NewDecoder(http_response.Body).Decode(&response); err != nil {
+			log.Printf("decoding webhook response failed: %v", err)
+			return ValidationResult{Decision: false, Valid: false}
+		}
+		if !response.Allow {
+			return ValidationResult{Decision: false, Valid: true}
+		}
+		return ValidationResult{
+			Decision: true,
+			Valid:    true,
+			Server:   response.Server,
+			Port:     response.Port,
+			User:     response.User,
+		}
+	}, nil
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/seiferma/nginxmailauthdelegator/internal/asserts"
+)
+
+// startTestWebhookServer starts an HTTPS server deciding on webhook requests
+// Returns the server and the path to its CA certificate file
+func startTestWebhookServer(t *testing.T, handler func(request webhookRequest) (int, webhookResponse)) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request webhookRequest
+		asserts.AssertNil(t, json.NewDecoder(r.Body).Decode(&request))
+		status, response := handler(request)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	ca_cert_file := t.TempDir() + "/ca.crt"
+	cert_pem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	asserts.AssertNil(t, os.WriteFile(ca_cert_file, cert_pem, 0644))
+
+	return server, ca_cert_file
+}
+
+func TestWebhookBackendValidCredentials(t *testing.T) {
+	server, ca_cert_file := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		asserts.AssertEquals(t, "username", request.User)
+		asserts.AssertEquals(t, "password", request.Password)
+		asserts.AssertEquals(t, "imap", request.Protocol)
+		asserts.AssertEquals(t, "192.0.2.1", request.ClientIp)
+		return http.StatusOK, webhookResponse{Allow: true, Server: "imap2.example.org", Port: 1993, User: "user*master"}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_PLAIN, ca_cert_file, time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	result := backend(ValidationRequest{Protocol: "imap", User: "username", Pass: "password", ClientIp: "192.0.2.1"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+	asserts.AssertEquals(t, "imap2.example.org", result.Server)
+	asserts.AssertEquals(t, 1993, result.Port)
+	asserts.AssertEquals(t, "user*master", result.User)
+}
+
+func TestWebhookBackendInvalidCredentials(t *testing.T) {
+	server, ca_cert_file := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		return http.StatusOK, webhookResponse{Allow: false}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_PLAIN, ca_cert_file, time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	result := backend(ValidationRequest{Protocol: "imap", User: "username", Pass: "wrongpass"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestWebhookBackendHashedPassword(t *testing.T) {
+	hash := sha256.Sum256([]byte("password"))
+	server, ca_cert_file := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		return http.StatusOK, webhookResponse{Allow: request.Password == hex.EncodeToString(hash[:])}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_SHA256, ca_cert_file, time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	result := backend(ValidationRequest{Protocol: "smtp", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, true, result.Valid)
+	asserts.AssertEquals(t, true, result.Decision)
+}
+
+func TestWebhookBackendServerError(t *testing.T) {
+	server, ca_cert_file := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		return http.StatusInternalServerError, webhookResponse{Allow: true}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_PLAIN, ca_cert_file, time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	result := backend(ValidationRequest{Protocol: "imap", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestWebhookBackendUntrustedCertificate(t *testing.T) {
+	server, _ := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		return http.StatusOK, webhookResponse{Allow: true}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_PLAIN, "", time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	result := backend(ValidationRequest{Protocol: "imap", User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, false, result.Decision)
+}
+
+func TestWebhookBackendRequiresHttps(t *testing.T) {
+	_, err := createWebhookBackend("http://auth.example.org/", WEBHOOK_PASSWORD_PLAIN, "", time.Second, &closeFuncs{})
+	asserts.AssertNonNil(t, err)
+	_, err = createWebhookBackend("https://auth.example.org/", "foo", "", time.Second, &closeFuncs{})
+	asserts.AssertNonNil(t, err)
+}
+
+func TestWebhookBackendStopsAtDeadlineOfRequest(t *testing.T) {
+	server, ca_cert_file := startTestWebhookServer(t, func(request webhookRequest) (int, webhookResponse) {
+		time.Sleep(500 * time.Millisecond)
+		return http.StatusOK, webhookResponse{Allow: true}
+	})
+	defer server.Close()
+
+	backend, err := createWebhookBackend(server.URL, WEBHOOK_PASSWORD_PLAIN, ca_cert_file, 10*time.Second, &closeFuncs{})
+	asserts.AssertNil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := backend(ValidationRequest{Ctx: ctx, User: "username", Pass: "password"})
+	asserts.AssertEquals(t, false, result.Valid)
+	asserts.AssertEquals(t, true, result.Timeout)
+	asserts.AssertEquals(t, true, time.Since(start) < 500*time.Millisecond)
+}